@@ -3,6 +3,9 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/angelini/fusion/internal/pb"
 	"github.com/angelini/fusion/pkg/manager"
@@ -11,7 +14,7 @@ import (
 	"go.uber.org/zap"
 )
 
-func createProject(ctx context.Context, log *zap.Logger, dlClient *dlc.Client, managerClient pb.ManagerClient, project int64, dir string) error {
+func createProject(ctx context.Context, log *zap.Logger, dlClient *dlc.Client, managerClient pb.ManagerClient, project int64, dir string, replicas int32, isolate bool) error {
 	err := dlClient.NewProject(ctx, project, nil, nil)
 	if err != nil {
 		return err
@@ -27,14 +30,17 @@ func createProject(ctx context.Context, log *zap.Logger, dlClient *dlc.Client, m
 	log.Info("dl fs updated", zap.Int64("project", project), zap.Int64("version", version))
 
 	bootResp, err := managerClient.BootSandbox(ctx, &pb.BootSandboxRequest{
-		Project: project,
-		Version: &version,
+		Project:  project,
+		Version:  &version,
+		Replicas: &replicas,
+		Isolate:  &isolate,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to boot sandbox: %w", err)
 	}
 
 	log.Info("sandbox booted", zap.Int64("epoch", bootResp.Epoch), zap.String("host", bootResp.Host), zap.Int32("port", bootResp.Port))
+	logUpdates(log, bootResp.Replicas)
 
 	healthResp, err := managerClient.CheckHealth(ctx, &pb.CheckHealthRequest{
 		Project: project,
@@ -43,12 +49,7 @@ func createProject(ctx context.Context, log *zap.Logger, dlClient *dlc.Client, m
 		return fmt.Errorf("failed to check sandbox health: %w", err)
 	}
 
-	status := "unhealthy"
-	if healthResp.Status == pb.CheckHealthResponse_HEALTHY {
-		status = "healthy"
-	}
-
-	log.Info("sandbox health", zap.String("status", status))
+	logHealth(log, healthResp)
 
 	return nil
 }
@@ -61,7 +62,7 @@ func updateProject(ctx context.Context, log *zap.Logger, dlClient *dlc.Client, m
 
 	log.Info("dl fs updated", zap.Int64("project", project), zap.Int64("version", version))
 
-	_, err = managerClient.SetVersion(ctx, &pb.SetVersionRequest{
+	versionResp, err := managerClient.SetVersion(ctx, &pb.SetVersionRequest{
 		Project: project,
 		Version: &version,
 	})
@@ -70,6 +71,7 @@ func updateProject(ctx context.Context, log *zap.Logger, dlClient *dlc.Client, m
 	}
 
 	log.Info("sandbox version updated", zap.Int64("project", project), zap.Int64("version", version))
+	logUpdates(log, versionResp.Replicas)
 
 	healthResp, err := managerClient.CheckHealth(ctx, &pb.CheckHealthRequest{
 		Project: project,
@@ -78,21 +80,143 @@ func updateProject(ctx context.Context, log *zap.Logger, dlClient *dlc.Client, m
 		return fmt.Errorf("failed to check sandbox health: %w", err)
 	}
 
-	status := "unhealthy"
-	if healthResp.Status == pb.CheckHealthResponse_HEALTHY {
-		status = "healthy"
+	logHealth(log, healthResp)
+
+	return nil
+}
+
+func streamLogs(ctx context.Context, log *zap.Logger, managerClient pb.ManagerClient, project int64) error {
+	stream, err := managerClient.StreamLogs(ctx, &pb.StreamLogsRequest{
+		Project: project,
+		Tail:    100,
+		Follow:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stream sandbox logs: %w", err)
+	}
+
+	for {
+		line, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to receive sandbox log line: %w", err)
+		}
+
+		fmt.Printf("%s [%s:%d v%d] %s\n", time.Unix(0, line.Timestamp).Format(time.RFC3339), line.Stream, line.Port, line.Version, line.Message)
+	}
+}
+
+func watchSandbox(ctx context.Context, managerClient pb.ManagerClient, project int64) error {
+	stream, err := managerClient.WatchSandbox(ctx, &pb.WatchSandboxRequest{
+		Project: project,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch sandbox: %w", err)
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to receive sandbox event: %w", err)
+		}
+
+		version := "-"
+		if event.Version != nil && *event.Version >= 0 {
+			version = fmt.Sprintf("v%d", *event.Version)
+		}
+		fmt.Printf("%s %s pod=%s ip=%s %s port=%d %s\n", time.Unix(0, event.Timestamp).Format(time.RFC3339), strings.ToLower(event.Type.String()),
+			event.Pod, event.Ip, version, event.Port, event.Message)
+	}
+}
+
+func logUpdates(log *zap.Logger, updates []*pb.ReplicaUpdate) {
+	for _, update := range updates {
+		if update.Error != "" {
+			log.Warn("replica rejected version", zap.String("pod", update.Pod), zap.String("ip", update.Ip), zap.String("error", update.Error))
+			continue
+		}
+		log.Info("replica updated", zap.String("pod", update.Pod), zap.String("ip", update.Ip), zap.Int64p("version", update.Version))
+	}
+}
+
+func logHealth(log *zap.Logger, health *pb.CheckHealthResponse) {
+	log.Info("sandbox health", zap.String("status", strings.ToLower(health.Status.String())), zap.Int64("version", health.Version))
+
+	for _, replica := range health.Replicas {
+		log.Info("replica health", zap.String("pod", replica.Pod), zap.String("ip", replica.Ip),
+			zap.String("status", strings.ToLower(replica.Status.String())), zap.Int64p("version", replica.Version),
+			zap.Int64p("pending", replica.PendingVersion), zap.String("state", replica.State), zap.String("error", replica.Error))
+	}
+}
+
+func stopSandbox(ctx context.Context, log *zap.Logger, managerClient pb.ManagerClient, project int64) error {
+	_, err := managerClient.StopSandbox(ctx, &pb.StopSandboxRequest{
+		Project: project,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stop sandbox: %w", err)
+	}
+
+	log.Info("sandbox stopped", zap.Int64("project", project))
+
+	return nil
+}
+
+func listSandboxes(ctx context.Context, managerClient pb.ManagerClient) error {
+	resp, err := managerClient.ListSandboxes(ctx, &pb.ListSandboxesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes: %w", err)
+	}
+
+	for _, sandbox := range resp.Sandboxes {
+		printSandbox(sandbox)
 	}
 
-	log.Info("sandbox health", zap.String("status", status))
+	return nil
+}
+
+func getSandbox(ctx context.Context, managerClient pb.ManagerClient, project int64) error {
+	resp, err := managerClient.GetSandbox(ctx, &pb.GetSandboxRequest{
+		Project: project,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get sandbox: %w", err)
+	}
+
+	printSandbox(resp.Sandbox)
+	for _, pod := range resp.Sandbox.Pods {
+		version := "-"
+		if pod.Version != nil {
+			version = fmt.Sprintf("v%d", *pod.Version)
+		}
+		fmt.Printf("  %s %s node=%s phase=%s ready=%t restarts=%d %s state=%s in_flight=%d idle=%.0fs %s\n",
+			pod.Name, pod.Ip, pod.Node, pod.Phase, pod.Ready, pod.Restarts, version, pod.State, pod.InFlight, pod.IdleSeconds, pod.Error)
+	}
 
 	return nil
 }
 
+func printSandbox(sandbox *pb.Sandbox) {
+	version := "-"
+	if sandbox.Version != nil {
+		version = fmt.Sprintf("v%d", *sandbox.Version)
+	}
+	fmt.Printf("%d %s %s %s epoch=%d replicas=%d/%d ips=%v created=%s\n", sandbox.Project, sandbox.Name, sandbox.Status, version,
+		sandbox.Epoch, sandbox.ReadyReplicas, sandbox.Replicas, sandbox.PodIps, time.Unix(sandbox.Created, 0).Format(time.RFC3339))
+}
+
 func NewCmdDebug() *cobra.Command {
 	var (
-		mode    string
-		project int64
-		dir     string
+		mode     string
+		project  int64
+		dir      string
+		replicas int32
+		isolate  bool
 	)
 
 	cmd := &cobra.Command{
@@ -102,9 +226,12 @@ func NewCmdDebug() *cobra.Command {
 			ctx := cmd.Context()
 			log := ctx.Value(logKey).(*zap.Logger)
 
-			if dir == "" {
+			if dir == "" && (mode == "create" || mode == "update") {
 				log.Fatal("--dir cannot be emtpy")
 			}
+			if project == 0 && mode != "list" {
+				log.Fatal("--project is required")
+			}
 
 			dlClient, err := dlc.NewClient(ctx, "dateilager.localdomain:443")
 			if err != nil {
@@ -118,11 +245,21 @@ func NewCmdDebug() *cobra.Command {
 
 			switch mode {
 			case "create":
-				return createProject(ctx, log, dlClient, managerClient, project, dir)
+				return createProject(ctx, log, dlClient, managerClient, project, dir, replicas, isolate)
 			case "update":
 				return updateProject(ctx, log, dlClient, managerClient, project, dir)
+			case "logs":
+				return streamLogs(ctx, log, managerClient, project)
+			case "stop":
+				return stopSandbox(ctx, log, managerClient, project)
+			case "list":
+				return listSandboxes(ctx, managerClient)
+			case "get":
+				return getSandbox(ctx, managerClient, project)
+			case "watch":
+				return watchSandbox(ctx, managerClient, project)
 			default:
-				log.Fatal("--mode must be either 'create' or 'update'")
+				log.Fatal("--mode must be either 'create', 'update', 'logs', 'stop', 'list', 'get' or 'watch'")
 			}
 
 			return nil
@@ -131,13 +268,13 @@ func NewCmdDebug() *cobra.Command {
 
 	flags := cmd.PersistentFlags()
 
-	flags.StringVar(&mode, "mode", "", "Debug mode (create | update)")
+	flags.StringVar(&mode, "mode", "", "Debug mode (create | update | logs | stop | list | get | watch)")
 	flags.Int64Var(&project, "project", 0, "Project ID")
 	flags.StringVar(&dir, "dir", "", "Directory to push to DateiLager")
+	flags.Int32Var(&replicas, "replicas", 1, "Sandbox replicas to boot")
+	flags.BoolVar(&isolate, "isolate", false, "Isolate the sandbox's processes, nodes must allow an unmasked /proc")
 
 	cmd.MarkFlagRequired("mode")
-	cmd.MarkFlagRequired("project")
-	cmd.MarkFlagRequired("dir")
 
 	return cmd
 }
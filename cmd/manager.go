@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"crypto/ed25519"
 	"crypto/tls"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/angelini/fusion/pkg/manager"
 	"github.com/spf13/cobra"
@@ -15,6 +17,9 @@ func NewCmdManager() *cobra.Command {
 		port     int
 		certFile string
 		keyFile  string
+
+		metaKeyPath string
+		idleTTL     time.Duration
 	)
 
 	cmd := &cobra.Command{
@@ -34,7 +39,17 @@ func NewCmdManager() *cobra.Command {
 				return fmt.Errorf("cannot open TLS cert and key files (%s, %s): %w", certFile, keyFile, err)
 			}
 
-			server, err := manager.NewServer(log, &cert, "fusion", "localhost/fusion:latest", "dateilager-server.fusion.svc.cluster.local")
+			metaKey, err := readKeyFile(metaKeyPath)
+			if err != nil {
+				return fmt.Errorf("cannot open meta private key %v: %w", metaKeyPath, err)
+			}
+
+			privateKey, ok := metaKey.(ed25519.PrivateKey)
+			if !ok {
+				return fmt.Errorf("meta private key %v is not an ed25519 key", metaKeyPath)
+			}
+
+			server, err := manager.NewServer(ctx, log, &cert, "fusion", "localhost/fusion:latest", "dateilager-server.fusion.svc.cluster.local", privateKey, idleTTL)
 			if err != nil {
 				return err
 			}
@@ -48,6 +63,8 @@ func NewCmdManager() *cobra.Command {
 	flags.IntVarP(&port, "port", "p", 5152, "Manager port")
 	flags.StringVar(&certFile, "cert", "development/server.crt", "TLS cert file")
 	flags.StringVar(&keyFile, "key", "development/server.key", "TLS key file")
+	flags.StringVar(&metaKeyPath, "meta-key", "development/meta.pem", "Private key signing sandbox meta API tokens")
+	flags.DurationVar(&idleTTL, "idle-ttl", manager.DEFAULT_IDLE_TTL, "Scale sandboxes that haven't served a request for this long to zero (0 to disable)")
 
 	return cmd
 }
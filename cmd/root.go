@@ -39,6 +39,7 @@ func NewCmdRoot() *cobra.Command {
 	cmd.AddCommand(NewCmdManager())
 	cmd.AddCommand(NewCmdPodProxy())
 	cmd.AddCommand(NewCmdSandbox())
+	cmd.AddCommand(NewCmdSandboxInit())
 	cmd.AddCommand(NewCmdDebug())
 	cmd.AddCommand(NewCmdPaseto())
 
@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/angelini/fusion/pkg/sandbox"
 	"github.com/spf13/cobra"
@@ -10,7 +12,24 @@ import (
 )
 
 func NewCmdSandbox() *cobra.Command {
-	var port int
+	var (
+		port          int
+		controlPort   int
+		publicKeyPath string
+		zeroDowntime  bool
+		socketDir     string
+		cgroupRoot    string
+		limits        sandbox.Limits
+		isolate       bool
+		isolateNet    bool
+		hidePaths     []string
+		follow        bool
+		followEvery   time.Duration
+		debounce      time.Duration
+		queueDepth    int
+		queueWait     time.Duration
+		concurrency   int
+	)
 
 	cmd := &cobra.Command{
 		Use:   "sandbox",
@@ -20,6 +39,24 @@ func NewCmdSandbox() *cobra.Command {
 			ctx := cmd.Context()
 			log := ctx.Value(logKey).(*zap.Logger)
 
+			err := requireFlag(cmd, cgroupRoot != "", "cgroup-root", "memory-max", "cpu-max", "pids-max")
+			if err == nil {
+				err = requireFlag(cmd, isolate, "isolate", "isolate-network", "isolate-hide")
+			}
+			if err == nil {
+				err = requireFlag(cmd, follow, "follow", "follow-interval", "follow-debounce")
+			}
+			if err != nil {
+				return err
+			}
+
+			if followEvery <= 0 {
+				return fmt.Errorf("--follow-interval must be positive, got %v", followEvery)
+			}
+			if debounce < 0 {
+				return fmt.Errorf("--follow-debounce can't be negative, got %v", debounce)
+			}
+
 			log.Info("start sandbox", zap.Int("port", port))
 
 			project, err := strconv.ParseInt(args[0], 10, 64)
@@ -27,17 +64,94 @@ func NewCmdSandbox() *cobra.Command {
 				return fmt.Errorf("cannot parse <project> arg: %w", err)
 			}
 
-			command := sandbox.NewCommand("node", []string{"/tmp/fusion/script.mjs"}, "/tmp/fusion")
-			controller, err := sandbox.NewController(ctx, log, "127.0.0.1", "dateilager-service.fusion.svc.cluster.local:5051", project, command, 8000)
+			publicKey, err := parsePublicKey(publicKeyPath)
 			if err != nil {
 				return err
 			}
 
-			return sandbox.StartProxy(ctx, log, controller, port)
+			command := sandbox.NewCommand("node", []string{"script.mjs"}, "/tmp/fusion")
+			options := sandbox.DefaultOptions()
+			options.ZeroDowntime = zeroDowntime
+			options.SocketDir = socketDir
+			options.CgroupRoot = cgroupRoot
+			options.Limits = limits
+			options.Follow = follow
+			options.FollowInterval = followEvery
+			options.FollowDebounce = debounce
+			options.MaxQueueDepth = queueDepth
+			options.MaxQueueWait = queueWait
+			options.MaxConcurrency = concurrency
+
+			if isolate {
+				options.Isolation = sandbox.DefaultIsolation()
+				options.Isolation.Network = isolateNet
+				options.Isolation.HidePaths = hidePaths
+			}
+
+			controller, err := sandbox.NewController(ctx, log, "127.0.0.1", "dateilager-service.fusion.svc.cluster.local:5051", project, command, 8000, options)
+			if err != nil {
+				return err
+			}
+
+			return sandbox.StartProxy(ctx, log, controller, port, controlPort, publicKey)
 		},
 	}
 
 	cmd.PersistentFlags().IntVarP(&port, "port", "p", 5152, "Sandbox proxy port")
+	cmd.PersistentFlags().IntVar(&controlPort, "control-port", 5153, "Sandbox meta API port")
+	cmd.PersistentFlags().StringVar(&publicKeyPath, "meta-public", "secrets/meta.pub", "Public key verifying the manager's meta API tokens")
+	cmd.PersistentFlags().BoolVar(&zeroDowntime, "zero-downtime", false, "Keep serving the current version while the next one boots")
+	cmd.PersistentFlags().StringVar(&socketDir, "socket-dir", "", "Listen on Unix domain sockets in this directory instead of TCP ports")
+	cmd.PersistentFlags().StringVar(&cgroupRoot, "cgroup-root", "", "Run each process in its own cgroup v2 under this directory")
+	cmd.PersistentFlags().StringVar(&limits.MemoryMax, "memory-max", "", "Per process memory.max (requires --cgroup-root)")
+	cmd.PersistentFlags().StringVar(&limits.CPUMax, "cpu-max", "", "Per process cpu.max (requires --cgroup-root)")
+	cmd.PersistentFlags().StringVar(&limits.PidsMax, "pids-max", "", "Per process pids.max (requires --cgroup-root)")
+	cmd.PersistentFlags().BoolVar(&isolate, "isolate", false, "Run each process in new mount and PID namespaces with a restricted environment")
+	cmd.PersistentFlags().BoolVar(&isolateNet, "isolate-network", false, "Also give each process an empty network namespace (requires --isolate and --socket-dir)")
+	cmd.PersistentFlags().StringSliceVar(&hidePaths, "isolate-hide", sandbox.DefaultIsolation().HidePaths, "Paths hidden from isolated processes (requires --isolate)")
+	cmd.PersistentFlags().BoolVar(&follow, "follow", false, "Automatically deploy the project's latest DateiLager version")
+	cmd.PersistentFlags().DurationVar(&followEvery, "follow-interval", sandbox.DEFAULT_FOLLOW_INTERVAL, "How often to poll for the latest version (requires --follow)")
+	cmd.PersistentFlags().DurationVar(&debounce, "follow-debounce", sandbox.DEFAULT_FOLLOW_DEBOUNCE, "How long the latest version must be stable before it's deployed (requires --follow)")
+	cmd.PersistentFlags().IntVar(&queueDepth, "max-queue-depth", sandbox.DEFAULT_MAX_QUEUE_DEPTH, "Requests that can wait for a live process before being rejected (0 for unlimited)")
+	cmd.PersistentFlags().DurationVar(&queueWait, "max-queue-wait", sandbox.DEFAULT_MAX_QUEUE_WAIT, "How long a request waits for a live process (0 for unlimited)")
+	cmd.PersistentFlags().IntVar(&concurrency, "max-concurrency", 0, "In-flight requests per process before requests are queued (0 for unlimited)")
+
+	return cmd
+}
+
+// requireFlag rejects flags that would be silently ignored because the flag they depend on isn't enabled.
+func requireFlag(cmd *cobra.Command, enabled bool, required string, names ...string) error {
+	if enabled {
+		return nil
+	}
+
+	for _, name := range names {
+		if cmd.Flags().Changed(name) {
+			return fmt.Errorf("--%s requires --%s", name, required)
+		}
+	}
+	return nil
+}
+
+// NewCmdSandboxInit is re-executed by the sandbox as PID 1 of isolated processes.
+func NewCmdSandboxInit() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "sandbox-init -- <exec> [args...]",
+		Short:  "Init process for isolated sandbox processes",
+		Hidden: true,
+		Args:   cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			code, err := sandbox.RunInit(args)
+			if err != nil {
+				return err
+			}
+
+			os.Exit(code)
+			return nil
+		},
+	}
+
+	cmd.Flags().SetInterspersed(false)
 
 	return cmd
 }
@@ -0,0 +1,65 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Type returns the protocol requested through an HTTP Upgrade, or "" for regular requests.
+func Type(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// Splice hijacks the client connection, forwards the 101 response and copies raw bytes in both
+// directions until either side closes.
+func Splice(resp http.ResponseWriter, proxyResp *http.Response) error {
+	backConn, ok := proxyResp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return fmt.Errorf("upgrade response body is not writable: %T", proxyResp.Body)
+	}
+	defer backConn.Close()
+
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		return errors.New("response writer does not support hijacking")
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		return fmt.Errorf("failed to hijack client connection: %w", err)
+	}
+	defer clientConn.Close()
+
+	proxyResp.Body = nil
+	err = proxyResp.Write(clientBuf)
+	if err != nil {
+		return fmt.Errorf("failed to write upgrade response: %w", err)
+	}
+
+	err = clientBuf.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush upgrade response: %w", err)
+	}
+
+	errChan := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backConn, clientBuf)
+		errChan <- err
+	}()
+	go func() {
+		_, err := io.Copy(clientConn, backConn)
+		errChan <- err
+	}()
+
+	return <-errChan
+}
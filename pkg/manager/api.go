@@ -3,21 +3,34 @@ package manager
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/angelini/fusion/internal/pb"
+	"github.com/angelini/fusion/pkg/sandbox"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	core "k8s.io/api/core/v1"
 )
 
 const (
-	HEALTH_CHECK_ATTEMPTS = 5
+	SANDBOX_PORT         = 5152
+	SANDBOX_CONTROL_PORT = 5153
+
+	SANDBOX_STATUS_TIMEOUT = 2 * time.Second
+	ENDPOINT_TIMEOUT       = 30 * time.Second
+
+	MAX_REPLICAS = 8
 )
 
 type ManagerApi struct {
@@ -27,10 +40,12 @@ type ManagerApi struct {
 	epoch      int64
 	namespace  string
 	image      string
+	metaKey    ed25519.PrivateKey
+	idleTTL    time.Duration
 	kubeClient *KubeClient
 }
 
-func NewManagerApi(log *zap.Logger, epoch int64, namespace, image, dlServer string) (*ManagerApi, error) {
+func NewManagerApi(log *zap.Logger, epoch int64, namespace, image, dlServer string, metaKey ed25519.PrivateKey, idleTTL time.Duration) (*ManagerApi, error) {
 	kubeClient, err := NewKubeClient(epoch, namespace, image)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create k8s client %v [%v]: %w", namespace, image, err)
@@ -41,32 +56,71 @@ func NewManagerApi(log *zap.Logger, epoch int64, namespace, image, dlServer stri
 		epoch:      epoch,
 		namespace:  namespace,
 		image:      image,
+		metaKey:    metaKey,
+		idleTTL:    idleTTL,
 		kubeClient: kubeClient,
 	}, nil
 }
 
 func (m *ManagerApi) BootSandbox(ctx context.Context, req *pb.BootSandboxRequest) (*pb.BootSandboxResponse, error) {
-	m.log.Info("boot sandbox", zap.Int64("project", req.Project))
+	m.log.Info("boot sandbox", zap.Int64("project", req.Project), zap.Int32p("replicas", req.Replicas))
 	name := m.name(req.Project)
 
-	err := m.kubeClient.CreateDeployment(ctx, name, req.Project)
+	// Running sandboxes and those woken up after being reaped boot into the version they were set to.
+	spec := SandboxSpec{Replicas: 1, Version: req.Version}
+	if info, err := m.kubeClient.GetSandbox(name); err == nil && !info.Terminating {
+		spec.Replicas = info.Replicas
+		spec.Isolate = info.Isolate
+		if spec.Version == nil {
+			spec.Version = info.Version
+		}
+	}
+	if req.Replicas != nil {
+		spec.Replicas = *req.Replicas
+	}
+	if req.Isolate != nil {
+		spec.Isolate = *req.Isolate
+	}
+	if spec.Replicas < 1 || spec.Replicas > MAX_REPLICAS {
+		return nil, status.Errorf(codes.InvalidArgument, "Manager.BootSandbox replicas must be between 1 and %v, got %v", MAX_REPLICAS, spec.Replicas)
+	}
+
+	err := m.kubeClient.CreateDeployment(ctx, name, req.Project, spec)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Manager.BootSandbox failed to boot %v: %v", name, err)
 	}
 
-	err = m.kubeClient.WaitForEndpoint(ctx, name)
+	waitCtx, cancel := context.WithTimeout(ctx, ENDPOINT_TIMEOUT)
+	defer cancel()
+
+	err = m.kubeClient.WaitForEndpoints(waitCtx, name, int(spec.Replicas))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Manager.BootSandbox failed to wait for %v: %v", name, err)
 	}
 
-	err = m.updateAllEndpoints(ctx, name, req.Version)
+	updates, err := m.updateAllEndpoints(ctx, req.Project, spec.Version)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Manager.BootSandbox failed to update versions %v: %v", name, err)
 	}
 
+	err = updatesErr(name, updates)
+	if err != nil {
+		return nil, err
+	}
+
+	// The deployment already records a requested version, only the one resolved for the latest is stored.
+	if spec.Version == nil {
+		spec.Version = acceptedVersion(spec.Version, updates)
+		err = m.kubeClient.UpdateVersion(ctx, name, req.Project, spec)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Manager.BootSandbox failed to store the version of %v: %v", name, err)
+		}
+	}
+
 	return &pb.BootSandboxResponse{
-		Epoch: m.epoch,
-		Host:  m.hostname(name),
+		Epoch:    m.epoch,
+		Host:     m.hostname(name),
+		Replicas: updates,
 	}, nil
 }
 
@@ -74,80 +128,530 @@ func (m *ManagerApi) SetVersion(ctx context.Context, req *pb.SetVersionRequest)
 	m.log.Info("set version", zap.Int64("project", req.Project), zap.Int64p("version", req.Version))
 	name := m.name(req.Project)
 
-	err := m.updateAllEndpoints(ctx, name, req.Version)
+	info, err := m.kubeClient.GetSandbox(name)
+	if errors.Is(err, ErrSandboxNotFound) {
+		return nil, status.Errorf(codes.NotFound, "Manager cannot find sandbox %v", name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Manager failed to get sandbox %v: %v", name, err)
+	}
+
+	// The version is stored before replicas are updated so that the converger never moves them back to the
+	// previous one, while the latest is resolved no version is stored and the converger leaves them alone.
+	spec := SandboxSpec{Replicas: info.Replicas, Version: req.Version, Idle: info.Idle, Isolate: info.Isolate}
+	err = m.kubeClient.UpdateVersion(ctx, name, req.Project, spec)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Manager failed to store the version of %v: %v", name, err)
+	}
+
+	updates, err := m.updateAllEndpoints(ctx, req.Project, req.Version)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Manager failed to update versions %v: %v", name, err)
 	}
 
-	return &pb.SetVersionResponse{}, nil
+	err = updatesErr(name, updates)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Version == nil {
+		spec.Version = acceptedVersion(req.Version, updates)
+		err = m.kubeClient.UpdateVersion(ctx, name, req.Project, spec)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Manager failed to store the version of %v: %v", name, err)
+		}
+	}
+
+	return &pb.SetVersionResponse{Replicas: updates}, nil
+}
+
+// acceptedVersion is the version replicas are converged to, the first one resolved by a replica when the
+// latest was requested.
+func acceptedVersion(requested *int64, updates []*pb.ReplicaUpdate) *int64 {
+	if requested != nil {
+		return requested
+	}
+
+	for _, update := range updates {
+		if update.Error == "" && update.Version != nil {
+			return update.Version
+		}
+	}
+	return nil
+}
+
+// updatesErr fails a version update only when no replica accepted it, partial failures are reported in
+// the per-replica results.
+func updatesErr(name string, updates []*pb.ReplicaUpdate) error {
+	if len(updates) == 0 {
+		return status.Errorf(codes.Unavailable, "Manager found no ready replicas of %v", name)
+	}
+
+	for _, update := range updates {
+		if update.Error == "" {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.Internal, "Manager failed to update every replica of %v: %v", name, updates[0].Error)
 }
 
+// CheckHealth reads the meta status of each of the project's pods, the sandbox is only HEALTHY once every
+// replica serves a live process of the same version. Sandboxes scaled to zero are IDLE.
 func (m *ManagerApi) CheckHealth(ctx context.Context, req *pb.CheckHealthRequest) (*pb.CheckHealthResponse, error) {
 	m.log.Info("check health", zap.Int64("project", req.Project))
 	name := m.name(req.Project)
-	client := &http.Client{
-		Timeout: 200 * time.Millisecond,
-	}
 
-	var resp *http.Response
-	var err error
+	info, err := m.kubeClient.GetSandbox(name)
+	if errors.Is(err, ErrSandboxNotFound) {
+		return nil, status.Errorf(codes.NotFound, "Manager found no sandbox %v", name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Manager failed to get %v: %v", name, err)
+	}
 
-	for idx := 0; idx < HEALTH_CHECK_ATTEMPTS; idx++ {
-		resp, err = client.Get(fmt.Sprintf("http://%s/health", m.hostname(name)))
-		if err == nil {
-			break
+	if info.Idle {
+		resp := &pb.CheckHealthResponse{Status: pb.CheckHealthResponse_IDLE, Version: -1}
+		if info.Version != nil {
+			resp.Version = *info.Version
 		}
-		if os.IsTimeout(err) && idx < HEALTH_CHECK_ATTEMPTS-1 {
+		return resp, nil
+	}
+
+	statusCtx, cancel := context.WithTimeout(ctx, SANDBOX_STATUS_TIMEOUT)
+	defer cancel()
+
+	var replicas []*pb.ReplicaHealth
+	var wg sync.WaitGroup
+
+	for _, pod := range info.Pods {
+		if pod.Terminating {
 			continue
 		}
-		return nil, status.Errorf(codes.Internal, "Manager failed to run health check %v: %v", name, err)
+
+		pod := pod
+		replica := &pb.ReplicaHealth{Pod: pod.Name, Ip: pod.IP}
+		replicas = append(replicas, replica)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.replicaHealth(statusCtx, req.Project, pod, replica)
+		}()
+	}
+	wg.Wait()
+
+	return aggregateHealth(replicas), nil
+}
+
+func (m *ManagerApi) replicaHealth(ctx context.Context, project int64, pod PodInfo, replica *pb.ReplicaHealth) {
+	if pod.Phase == core.PodFailed {
+		replica.Status = pb.CheckHealthResponse_UNHEALTHY
+		replica.State = string(pod.Phase)
+		return
+	}
+	if !pod.Ready || pod.IP == "" {
+		replica.Status = pb.CheckHealthResponse_BOOTING
+		replica.State = string(pod.Phase)
+		return
+	}
+
+	metaStatus, err := m.sandboxStatus(ctx, project, pod.IP)
+	if err != nil {
+		replica.Status = pb.CheckHealthResponse_UNHEALTHY
+		replica.Error = err.Error()
+		return
+	}
+
+	if metaStatus.Next != nil {
+		replica.PendingVersion = &metaStatus.Next.Version
+	}
+	replica.Error = metaStatus.Error
+	if replica.Error == "" && metaStatus.LastFailure != nil {
+		replica.Error = metaStatus.LastFailure.Error()
+	}
+
+	switch {
+	case metaStatus.Current != nil && metaStatus.Error == "":
+		replica.Status = pb.CheckHealthResponse_HEALTHY
+		replica.Version = &metaStatus.Current.Version
+		replica.State = string(metaStatus.Current.State)
+	case metaStatus.Next != nil && metaStatus.Error == "":
+		replica.Status = pb.CheckHealthResponse_BOOTING
+		replica.State = string(metaStatus.Next.State)
+	default:
+		replica.Status = pb.CheckHealthResponse_UNHEALTHY
+	}
+}
+
+func aggregateHealth(replicas []*pb.ReplicaHealth) *pb.CheckHealthResponse {
+	resp := &pb.CheckHealthResponse{
+		Status:   pb.CheckHealthResponse_BOOTING,
+		Version:  -1,
+		Replicas: replicas,
+	}
+
+	healthy, booting := 0, 0
+	versions := make(map[int64]bool)
+	for _, replica := range replicas {
+		switch replica.Status {
+		case pb.CheckHealthResponse_HEALTHY:
+			healthy += 1
+			versions[*replica.Version] = true
+		case pb.CheckHealthResponse_BOOTING:
+			booting += 1
+		}
 	}
 
-	status := pb.CheckHealthResponse_UNHEALTHY
-	if resp.StatusCode < 300 {
-		status = pb.CheckHealthResponse_HEALTHY
+	switch {
+	case len(replicas) == 0:
+		// The deployment's pods haven't been scheduled yet.
+	case healthy == len(replicas) && len(versions) == 1:
+		resp.Status = pb.CheckHealthResponse_HEALTHY
+	case healthy > 0:
+		resp.Status = pb.CheckHealthResponse_DEGRADED
+	case booting > 0:
+		resp.Status = pb.CheckHealthResponse_BOOTING
+	default:
+		resp.Status = pb.CheckHealthResponse_UNHEALTHY
 	}
 
-	return &pb.CheckHealthResponse{
-		Status:  status,
-		Version: -1,
-	}, nil
+	if len(versions) == 1 {
+		for version := range versions {
+			resp.Version = version
+		}
+	}
+
+	return resp
 }
 
-func (m *ManagerApi) hostname(name string) string {
-	return fmt.Sprintf("%s.%s.svc.cluster.local", name, m.namespace)
+func (m *ManagerApi) StreamLogs(req *pb.StreamLogsRequest, stream pb.Manager_StreamLogsServer) error {
+	m.log.Info("stream logs", zap.Int64("project", req.Project), zap.Bool("follow", req.Follow))
+	ctx := stream.Context()
+	name := m.name(req.Project)
+
+	endpoints, err := m.kubeClient.GetAllEndpoints(name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Manager failed to list endpoints %v: %v", name, err)
+	}
+
+	query := url.Values{}
+	query.Set("tail", strconv.Itoa(int(req.Tail)))
+	query.Set("follow", strconv.FormatBool(req.Follow))
+	if req.Since != nil {
+		query.Set("since", time.Unix(*req.Since, 0).Format(time.RFC3339))
+	}
+
+	var sendMutex sync.Mutex
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	for _, endpoint := range endpoints {
+		ip := endpoint.IP
+
+		group.Go(func() error {
+			return m.streamSandboxLogs(groupCtx, req.Project, ip, query, func(line *pb.LogLine) error {
+				sendMutex.Lock()
+				defer sendMutex.Unlock()
+
+				return stream.Send(line)
+			})
+		})
+	}
+
+	err = group.Wait()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Manager failed to stream logs %v: %v", name, err)
+	}
+
+	return nil
 }
 
-func (m *ManagerApi) name(project int64) string {
-	return fmt.Sprintf("s-%d", project)
+func (m *ManagerApi) StopSandbox(ctx context.Context, req *pb.StopSandboxRequest) (*pb.StopSandboxResponse, error) {
+	m.log.Info("stop sandbox", zap.Int64("project", req.Project))
+	name := m.name(req.Project)
+
+	err := m.deleteSandbox(ctx, req.Project)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Manager failed to stop %v: %v", name, err)
+	}
+
+	return &pb.StopSandboxResponse{}, nil
 }
 
-func (m *ManagerApi) updateAllEndpoints(ctx context.Context, name string, version *int64) error {
-	ips, err := m.kubeClient.GetAllEndpoints(ctx, name)
+func (m *ManagerApi) ListSandboxes(ctx context.Context, req *pb.ListSandboxesRequest) (*pb.ListSandboxesResponse, error) {
+	m.log.Info("list sandboxes")
+
+	infos, err := m.kubeClient.ListSandboxes()
 	if err != nil {
-		return err
+		return nil, status.Errorf(codes.Internal, "Manager failed to list sandboxes: %v", err)
 	}
 
-	client := &http.Client{}
-	group, _ := errgroup.WithContext(ctx)
+	sandboxes := make([]*pb.Sandbox, len(infos))
+	group, groupCtx := errgroup.WithContext(ctx)
 
-	for _, ip := range ips {
-		ip := ip
-		if ip == "" {
+	for idx, info := range infos {
+		idx, info := idx, info
+		group.Go(func() error {
+			sandboxes[idx] = m.sandboxProto(groupCtx, &info, false)
+			return nil
+		})
+	}
+	group.Wait()
+
+	return &pb.ListSandboxesResponse{Sandboxes: sandboxes}, nil
+}
+
+func (m *ManagerApi) GetSandbox(ctx context.Context, req *pb.GetSandboxRequest) (*pb.GetSandboxResponse, error) {
+	m.log.Info("get sandbox", zap.Int64("project", req.Project))
+	name := m.name(req.Project)
+
+	info, err := m.kubeClient.GetSandbox(name)
+	if errors.Is(err, ErrSandboxNotFound) {
+		return nil, status.Errorf(codes.NotFound, "Manager found no sandbox %v", name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Manager failed to get %v: %v", name, err)
+	}
+
+	return &pb.GetSandboxResponse{Sandbox: m.sandboxProto(ctx, info, true)}, nil
+}
+
+// sandboxProto describes a sandbox, reading the version served by each ready pod from its meta API. Pods
+// that can't be reached are reported without a version rather than failing the request.
+func (m *ManagerApi) sandboxProto(ctx context.Context, info *SandboxInfo, detailed bool) *pb.Sandbox {
+	sandbox := &pb.Sandbox{
+		Project:       info.Project,
+		Name:          info.Name,
+		Epoch:         info.Epoch,
+		Host:          m.hostname(info.Name),
+		Status:        pb.Sandbox_PENDING,
+		Replicas:      info.Replicas,
+		ReadyReplicas: info.ReadyReplicas,
+		Created:       info.Created.Unix(),
+	}
+
+	switch {
+	case info.Terminating:
+		sandbox.Status = pb.Sandbox_TERMINATING
+	case info.Idle:
+		sandbox.Status = pb.Sandbox_IDLE
+	case info.ReadyReplicas > 0 && info.ReadyReplicas >= info.Replicas:
+		sandbox.Status = pb.Sandbox_READY
+	}
+
+	statusCtx, cancel := context.WithTimeout(ctx, SANDBOX_STATUS_TIMEOUT)
+	defer cancel()
+
+	pods := make([]*pb.SandboxPod, len(info.Pods))
+	var wg sync.WaitGroup
+
+	for idx, podInfo := range info.Pods {
+		pod := &pb.SandboxPod{
+			Name:     podInfo.Name,
+			Ip:       podInfo.IP,
+			Node:     podInfo.Node,
+			Phase:    string(podInfo.Phase),
+			Ready:    podInfo.Ready,
+			Restarts: podInfo.Restarts,
+		}
+		if !podInfo.Started.IsZero() {
+			pod.Started = podInfo.Started.Unix()
+		}
+		pods[idx] = pod
+
+		if !podInfo.Ready {
 			continue
 		}
 
-		version, err := json.Marshal(map[string]*int64{"version": version})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			metaStatus, err := m.sandboxStatus(statusCtx, info.Project, pod.Ip)
+			if err != nil {
+				pod.Error = err.Error()
+				return
+			}
+
+			pod.InFlight = int32(metaStatus.InFlight)
+			pod.IdleSeconds = metaStatus.IdleSeconds
+			pod.Error = metaStatus.Error
+			switch {
+			case metaStatus.Current != nil:
+				pod.Version = &metaStatus.Current.Version
+				pod.State = string(metaStatus.Current.State)
+			case metaStatus.Next != nil:
+				pod.State = string(metaStatus.Next.State)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, pod := range pods {
+		if pod.Ip != "" {
+			sandbox.PodIps = append(sandbox.PodIps, pod.Ip)
+		}
+		if sandbox.Version == nil && pod.Version != nil {
+			sandbox.Version = pod.Version
+		}
+	}
+
+	if detailed {
+		sandbox.Pods = pods
+	}
+
+	return sandbox
+}
+
+func (m *ManagerApi) deleteSandbox(ctx context.Context, project int64) error {
+	name := m.name(project)
+
+	err := m.kubeClient.DeleteService(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return m.kubeClient.DeleteDeployment(ctx, name)
+}
+
+func (m *ManagerApi) streamSandboxLogs(ctx context.Context, project int64, ip string, query url.Values, send func(*pb.LogLine) error) error {
+	req, err := m.metaRequest(ctx, http.MethodGet, project, ip, "logs?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("sandbox %v rejected logs request (%v): %s", ip, resp.StatusCode, message)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var line sandbox.LogLine
+		err := decoder.Decode(&line)
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode log line from %v: %w", ip, err)
+		}
+
+		err = send(&pb.LogLine{
+			Host:      ip,
+			Seq:       int64(line.Seq),
+			Timestamp: line.At.UnixNano(),
+			Stream:    line.Stream,
+			Port:      int32(line.Port),
+			Version:   line.Version,
+			Message:   line.Message,
+		})
 		if err != nil {
 			return err
 		}
-		body := bytes.NewBuffer(version)
+	}
+}
 
-		group.Go(func() error {
-			_, err = client.Post(fmt.Sprintf("http://%s:5152/__meta__/version", ip), "application/json", body)
-			return err
-		})
+// metaRequest builds a request to the meta API of project's sandbox pod at ip, authorized by a freshly
+// signed token for that method and path.
+func (m *ManagerApi) metaRequest(ctx context.Context, method string, project int64, ip, path string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s:%d%s%s", ip, SANDBOX_CONTROL_PORT, sandbox.META_PREFIX, path), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := sandbox.SignMetaToken(m.metaKey, project, method, req.URL.Path, req.URL.RawQuery, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign meta token: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return req, nil
+}
+
+func (m *ManagerApi) hostname(name string) string {
+	return fmt.Sprintf("%s.%s.svc.cluster.local", name, m.namespace)
+}
+
+func (m *ManagerApi) name(project int64) string {
+	return fmt.Sprintf("s-%d", project)
+}
+
+// updateAllEndpoints sets the version of every ready replica concurrently and returns the result of each.
+func (m *ManagerApi) updateAllEndpoints(ctx context.Context, project int64, version *int64) ([]*pb.ReplicaUpdate, error) {
+	endpoints, err := m.kubeClient.GetAllEndpoints(m.name(project))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string]*int64{"version": version})
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make([]*pb.ReplicaUpdate, len(endpoints))
+	var wg sync.WaitGroup
+
+	for idx, endpoint := range endpoints {
+		idx, endpoint := idx, endpoint
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			update := &pb.ReplicaUpdate{Pod: endpoint.Pod, Ip: endpoint.IP}
+			version, err := m.setReplicaVersion(ctx, project, endpoint.IP, body)
+			if err != nil {
+				m.log.Warn("failed to update replica version", zap.Int64("project", project), zap.String("ip", endpoint.IP), zap.Error(err))
+				update.Error = err.Error()
+			} else {
+				update.Version = &version
+			}
+			updates[idx] = update
+		}()
+	}
+	wg.Wait()
+
+	return updates, nil
+}
+
+// setReplicaVersion returns the version the replica started once it's promoted.
+func (m *ManagerApi) setReplicaVersion(ctx context.Context, project int64, ip string, body []byte) (int64, error) {
+	req, err := m.metaRequest(ctx, http.MethodPost, project, ip, "version", body)
+	if err != nil {
+		return -1, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return -1, fmt.Errorf("sandbox %v rejected version (%v): %s", ip, resp.StatusCode, message)
+	}
+
+	var versionResp sandbox.VersionResponse
+	err = json.NewDecoder(resp.Body).Decode(&versionResp)
+	if err != nil {
+		return -1, fmt.Errorf("failed to decode version from %v: %w", ip, err)
 	}
 
-	return group.Wait()
+	return versionResp.Version, nil
 }
@@ -0,0 +1,89 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/angelini/fusion/internal/pb"
+)
+
+func replica(status pb.CheckHealthResponse_HealthStatus, version int64) *pb.ReplicaHealth {
+	replica := &pb.ReplicaHealth{Status: status}
+	if status == pb.CheckHealthResponse_HEALTHY {
+		replica.Version = &version
+	}
+	return replica
+}
+
+func TestAggregateHealth(t *testing.T) {
+	cases := []struct {
+		name     string
+		replicas []*pb.ReplicaHealth
+		status   pb.CheckHealthResponse_HealthStatus
+		version  int64
+	}{
+		{
+			name:    "no replicas",
+			status:  pb.CheckHealthResponse_BOOTING,
+			version: -1,
+		},
+		{
+			name: "all healthy",
+			replicas: []*pb.ReplicaHealth{
+				replica(pb.CheckHealthResponse_HEALTHY, 3),
+				replica(pb.CheckHealthResponse_HEALTHY, 3),
+			},
+			status:  pb.CheckHealthResponse_HEALTHY,
+			version: 3,
+		},
+		{
+			name: "mixed versions",
+			replicas: []*pb.ReplicaHealth{
+				replica(pb.CheckHealthResponse_HEALTHY, 3),
+				replica(pb.CheckHealthResponse_HEALTHY, 4),
+			},
+			status:  pb.CheckHealthResponse_DEGRADED,
+			version: -1,
+		},
+		{
+			name: "some healthy",
+			replicas: []*pb.ReplicaHealth{
+				replica(pb.CheckHealthResponse_HEALTHY, 3),
+				replica(pb.CheckHealthResponse_UNHEALTHY, 0),
+			},
+			status:  pb.CheckHealthResponse_DEGRADED,
+			version: 3,
+		},
+		{
+			name: "booting",
+			replicas: []*pb.ReplicaHealth{
+				replica(pb.CheckHealthResponse_BOOTING, 0),
+				replica(pb.CheckHealthResponse_UNHEALTHY, 0),
+			},
+			status:  pb.CheckHealthResponse_BOOTING,
+			version: -1,
+		},
+		{
+			name: "all unhealthy",
+			replicas: []*pb.ReplicaHealth{
+				replica(pb.CheckHealthResponse_UNHEALTHY, 0),
+			},
+			status:  pb.CheckHealthResponse_UNHEALTHY,
+			version: -1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := aggregateHealth(tc.replicas)
+			if resp.Status != tc.status {
+				t.Fatalf("expected status %v, got %v", tc.status, resp.Status)
+			}
+			if resp.Version != tc.version {
+				t.Fatalf("expected version %v, got %v", tc.version, resp.Version)
+			}
+			if len(resp.Replicas) != len(tc.replicas) {
+				t.Fatalf("expected %v replicas, got %v", len(tc.replicas), len(resp.Replicas))
+			}
+		})
+	}
+}
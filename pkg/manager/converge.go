@@ -0,0 +1,183 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	CONVERGE_INTERVAL = 30 * time.Second
+	CONVERGE_TIMEOUT  = 2 * time.Minute
+)
+
+// replicaVersion tracks what the converger knows about a replica, keyed by its pod and IP so that
+// restarted pods are checked again.
+type replicaVersion struct {
+	version   int64
+	converged bool
+	pending   bool
+	retryAt   time.Time
+}
+
+// versionConverger starts the version stored on each sandbox's deployment on replicas that don't serve
+// it, such as new or restarted replicas which boot without a version.
+type versionConverger struct {
+	api *ManagerApi
+
+	mutex    sync.Mutex
+	replicas map[string]*replicaVersion
+}
+
+// convergeVersions checks the replicas of every sandbox whenever the cache changes, replicas already on
+// their version are checked again every CONVERGE_INTERVAL.
+func (m *ManagerApi) convergeVersions(ctx context.Context) {
+	converger := &versionConverger{
+		api:      m,
+		replicas: make(map[string]*replicaVersion),
+	}
+
+	ticker := time.NewTicker(CONVERGE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		changed := m.kubeClient.cacheChanged()
+		converger.convergeOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+			converger.reset()
+		}
+	}
+}
+
+func (v *versionConverger) reset() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for _, replica := range v.replicas {
+		replica.converged = false
+	}
+}
+
+func (v *versionConverger) convergeOnce(ctx context.Context) {
+	sandboxes, err := v.api.kubeClient.ListSandboxes()
+	if err != nil {
+		v.api.log.Warn("failed to list sandboxes to converge", zap.Error(err))
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, info := range sandboxes {
+		if info.Terminating || info.Idle || info.Version == nil {
+			continue
+		}
+
+		endpoints, err := v.api.kubeClient.GetAllEndpoints(info.Name)
+		if err != nil {
+			v.api.log.Warn("failed to list endpoints to converge", zap.String("name", info.Name), zap.Error(err))
+			continue
+		}
+
+		for _, endpoint := range endpoints {
+			key := fmt.Sprintf("%s/%s", endpoint.Pod, endpoint.IP)
+			seen[key] = true
+
+			if v.claim(key, *info.Version) {
+				go v.convergeReplica(ctx, info.Project, endpoint.IP, key, *info.Version)
+			}
+		}
+	}
+
+	// Replicas that left their service, even briefly while restarting, are checked again when they're back.
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for key, replica := range v.replicas {
+		if !seen[key] && !replica.pending {
+			delete(v.replicas, key)
+		}
+	}
+}
+
+// claim returns whether the replica at key needs to be checked, marking it as pending.
+func (v *versionConverger) claim(key string, version int64) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	replica, ok := v.replicas[key]
+	if !ok {
+		replica = &replicaVersion{}
+		v.replicas[key] = replica
+	}
+
+	if replica.pending {
+		return false
+	}
+	if replica.version == version && (replica.converged || time.Now().Before(replica.retryAt)) {
+		return false
+	}
+
+	replica.version = version
+	replica.converged = false
+	replica.pending = true
+	return true
+}
+
+func (v *versionConverger) convergeReplica(ctx context.Context, project int64, ip, key string, version int64) {
+	ctx, cancel := context.WithTimeout(ctx, CONVERGE_TIMEOUT)
+	defer cancel()
+
+	log := v.api.log.With(zap.Int64("project", project), zap.String("ip", ip), zap.Int64("version", version))
+
+	converged, err := v.replicaConverged(ctx, project, ip, version)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	replica := v.replicas[key]
+	replica.pending = false
+
+	if err != nil {
+		log.Warn("failed to converge replica version", zap.Error(err))
+		replica.retryAt = time.Now().Add(CONVERGE_INTERVAL)
+		return
+	}
+	replica.converged = converged
+}
+
+// replicaConverged starts version on the replica unless it already serves it. Replicas still booting a
+// version and those following the latest are left alone, the first are checked again on the next pass.
+func (v *versionConverger) replicaConverged(ctx context.Context, project int64, ip string, version int64) (bool, error) {
+	status, err := v.api.sandboxStatus(ctx, project, ip)
+	if err != nil {
+		return false, err
+	}
+
+	if status.Follow || (status.Current != nil && status.Current.Version == version) {
+		return true, nil
+	}
+	if status.Next != nil {
+		return false, nil
+	}
+
+	v.api.log.Info("converge replica version", zap.Int64("project", project), zap.String("ip", ip), zap.Int64("version", version))
+
+	body, err := json.Marshal(map[string]*int64{"version": &version})
+	if err != nil {
+		return false, err
+	}
+
+	_, err = v.api.setReplicaVersion(ctx, project, ip, body)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -2,29 +2,68 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	apps "k8s.io/api/apps/v1"
 	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
 	appsconf "k8s.io/client-go/applyconfigurations/apps/v1"
 	coreconf "k8s.io/client-go/applyconfigurations/core/v1"
 	metaconf "k8s.io/client-go/applyconfigurations/meta/v1"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	FIELD_MANAGER = "fusion/manager"
+
+	LABEL_TYPE    = "fusion/type"
+	LABEL_NAME    = "fusion/name"
+	LABEL_EPOCH   = "fusion/epoch"
+	LABEL_PROJECT = "fusion/project"
+
+	// Sandboxes scaled to zero keep their replica count in an annotation to boot back into, every sandbox
+	// keeps the version its replicas should serve.
+	ANNOTATION_REPLICAS = "fusion/replicas"
+	ANNOTATION_VERSION  = "fusion/version"
+
+	// Sandboxes booted with isolation keep it when they're re-applied.
+	ANNOTATION_ISOLATE = "fusion/isolate"
 )
 
+// KubeClient applies sandbox resources through the API server and reads them back from a cache kept up to
+// date by shared informers, which only track fusion sandboxes in the manager's namespace.
 type KubeClient struct {
 	epoch     int64
 	namespace string
 	image     string
 	set       *kubernetes.Clientset
+
+	factory     informers.SharedInformerFactory
+	deployments appslisters.DeploymentLister
+	pods        corelisters.PodLister
+	slices      discoverylisters.EndpointSliceLister
+
+	cacheMutex    sync.Mutex
+	changed       chan struct{}
+	subscriptions map[*Subscription]bool
 }
 
 func NewKubeClient(epoch int64, namespace, image string) (*KubeClient, error) {
@@ -38,20 +77,260 @@ func NewKubeClient(epoch int64, namespace, image string) (*KubeClient, error) {
 		return nil, fmt.Errorf("cannot build clientset: %w", err)
 	}
 
-	return &KubeClient{
+	// Services carry the sandbox labels so that the endpoint slices mirroring them match the same selector.
+	factory := informers.NewSharedInformerFactoryWithOptions(set, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *meta.ListOptions) {
+			options.LabelSelector = fmt.Sprintf("%s=node", LABEL_TYPE)
+		}),
+	)
+
+	client := &KubeClient{
 		epoch:     epoch,
 		namespace: namespace,
 		image:     image,
 		set:       set,
-	}, nil
+		factory:   factory,
+		changed:   make(chan struct{}),
+
+		subscriptions: make(map[*Subscription]bool),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { client.notify(watch.Added, obj) },
+		UpdateFunc: func(_, obj interface{}) { client.notify(watch.Modified, obj) },
+		DeleteFunc: func(obj interface{}) { client.notify(watch.Deleted, obj) },
+	}
+
+	deployments := factory.Apps().V1().Deployments()
+	deployments.Informer().AddEventHandler(handler)
+	client.deployments = deployments.Lister()
+
+	pods := factory.Core().V1().Pods()
+	pods.Informer().AddEventHandler(handler)
+	client.pods = pods.Lister()
+
+	slices := factory.Discovery().V1().EndpointSlices()
+	slices.Informer().AddEventHandler(handler)
+	client.slices = slices.Lister()
+
+	return client, nil
 }
 
-func (c *KubeClient) CreateDeployment(ctx context.Context, name string, project int64) error {
-	_, err := c.set.AppsV1().
-		Deployments(c.namespace).
-		Apply(ctx, c.genDeployment(name, project), meta.ApplyOptions{FieldManager: FIELD_MANAGER})
+// Start runs the informers until ctx is done and waits for their caches to fill.
+func (c *KubeClient) Start(ctx context.Context) error {
+	c.factory.Start(ctx.Done())
+
+	for informer, synced := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("cannot sync %v cache", informer)
+		}
+	}
+
+	return c.backfillServices(ctx)
+}
+
+// backfillServices labels the services of sandboxes created before services carried the sandbox labels,
+// the endpoint slices mirroring them would otherwise be missing from the cache.
+func (c *KubeClient) backfillServices(ctx context.Context) error {
+	services, err := c.set.CoreV1().
+		Services(c.namespace).
+		List(ctx, meta.ListOptions{LabelSelector: "!" + LABEL_TYPE})
 	if err != nil {
-		return fmt.Errorf("cannot apply deployment %v: %w", name, err)
+		return fmt.Errorf("cannot list unlabeled services: %w", err)
+	}
+
+	for _, service := range services.Items {
+		deployment, err := c.deployments.Deployments(c.namespace).Get(service.Name)
+		if kerrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot get deployment %v: %w", service.Name, err)
+		}
+		if _, ok := sandboxInfo(deployment); !ok {
+			continue
+		}
+
+		_, err = c.set.CoreV1().
+			Services(c.namespace).
+			Apply(ctx, c.genService(service.Name), meta.ApplyOptions{FieldManager: FIELD_MANAGER})
+		if err != nil {
+			return fmt.Errorf("cannot label service %v: %w", service.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *KubeClient) broadcast() {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// cacheChanged returns a channel that is closed the next time a cached resource changes.
+func (c *KubeClient) cacheChanged() <-chan struct{} {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	return c.changed
+}
+
+// notify wakes up everything waiting on the cache and queues the change on the subscriptions to its sandbox.
+func (c *KubeClient) notify(eventType watch.EventType, obj interface{}) {
+	c.broadcast()
+
+	object, name, ok := sandboxResource(obj)
+	if !ok {
+		return
+	}
+
+	c.cacheMutex.Lock()
+	var subscriptions []*Subscription
+	for subscription := range c.subscriptions {
+		if subscription.name == name {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	c.cacheMutex.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.push(watch.Event{Type: eventType, Object: object})
+	}
+}
+
+// sandboxResource returns a cached resource along with the name of the sandbox it belongs to.
+func sandboxResource(obj interface{}) (runtime.Object, string, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	switch resource := obj.(type) {
+	case *apps.Deployment:
+		return resource, resource.Name, true
+	case *core.Pod:
+		return resource, resource.Labels[LABEL_NAME], true
+	case *discovery.EndpointSlice:
+		return resource, resource.Labels[discovery.LabelServiceName], true
+	}
+
+	return nil, "", false
+}
+
+// Subscription queues the changes to the cached deployment, pods and endpoint slices of one sandbox, starting
+// with their current state. Events are never dropped, a slow reader only grows its own queue.
+type Subscription struct {
+	name    string
+	mutex   sync.Mutex
+	pending []watch.Event
+	ready   chan struct{}
+}
+
+func (c *KubeClient) Subscribe(name string) (*Subscription, error) {
+	subscription := &Subscription{
+		name:  name,
+		ready: make(chan struct{}, 1),
+	}
+
+	// Changes made while replaying the cache are queued behind it, they are at least as recent.
+	subscription.mutex.Lock()
+	defer subscription.mutex.Unlock()
+
+	c.cacheMutex.Lock()
+	c.subscriptions[subscription] = true
+	c.cacheMutex.Unlock()
+
+	deployment, err := c.deployments.Deployments(c.namespace).Get(name)
+	if err != nil && !kerrors.IsNotFound(err) {
+		c.Unsubscribe(subscription)
+		return nil, fmt.Errorf("cannot get deployment %v: %w", name, err)
+	}
+	if err == nil {
+		subscription.pushLocked(watch.Event{Type: watch.Added, Object: deployment})
+	}
+
+	pods, err := c.pods.Pods(c.namespace).List(labels.SelectorFromSet(labels.Set{LABEL_NAME: name}))
+	if err != nil {
+		c.Unsubscribe(subscription)
+		return nil, fmt.Errorf("cannot list pods of %v: %w", name, err)
+	}
+	for _, pod := range pods {
+		subscription.pushLocked(watch.Event{Type: watch.Added, Object: pod})
+	}
+
+	slices, err := c.slices.EndpointSlices(c.namespace).
+		List(labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: name}))
+	if err != nil {
+		c.Unsubscribe(subscription)
+		return nil, fmt.Errorf("cannot list endpoints of %v: %w", name, err)
+	}
+	for _, slice := range slices {
+		subscription.pushLocked(watch.Event{Type: watch.Added, Object: slice})
+	}
+
+	return subscription, nil
+}
+
+func (c *KubeClient) Unsubscribe(subscription *Subscription) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	delete(c.subscriptions, subscription)
+}
+
+func (s *Subscription) push(event watch.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pushLocked(event)
+}
+
+func (s *Subscription) pushLocked(event watch.Event) {
+	s.pending = append(s.pending, event)
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Next blocks until an event is queued or ctx is done.
+func (s *Subscription) Next(ctx context.Context) (watch.Event, error) {
+	for {
+		s.mutex.Lock()
+		if len(s.pending) > 0 {
+			event := s.pending[0]
+			s.pending[0] = watch.Event{}
+			s.pending = s.pending[1:]
+			s.mutex.Unlock()
+			return event, nil
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return watch.Event{}, ctx.Err()
+		case <-s.ready:
+		}
+	}
+}
+
+// SandboxSpec is the desired state of a sandbox deployment. Idle sandboxes are scaled to zero but keep
+// Replicas and Version so that they boot back into the same state.
+type SandboxSpec struct {
+	Replicas int32
+	Version  *int64
+	Idle     bool
+	Isolate  bool
+}
+
+func (c *KubeClient) CreateDeployment(ctx context.Context, name string, project int64, spec SandboxSpec) error {
+	err := c.applyDeployment(ctx, name, project, spec)
+	if err != nil {
+		return err
 	}
 
 	_, err = c.set.CoreV1().
@@ -64,71 +343,320 @@ func (c *KubeClient) CreateDeployment(ctx context.Context, name string, project
 	return nil
 }
 
+// UpdateVersion records the version a sandbox's replicas should serve, replicas that don't serve it are
+// converged to it by the manager.
+func (c *KubeClient) UpdateVersion(ctx context.Context, name string, project int64, spec SandboxSpec) error {
+	return c.applyDeployment(ctx, name, project, spec)
+}
+
+// IdleDeployment scales a sandbox to zero, its service is kept so that requests keep resolving and fail
+// to connect until the sandbox is booted again.
+func (c *KubeClient) IdleDeployment(ctx context.Context, name string, project int64, spec SandboxSpec) error {
+	spec.Idle = true
+	return c.applyDeployment(ctx, name, project, spec)
+}
+
+func (c *KubeClient) applyDeployment(ctx context.Context, name string, project int64, spec SandboxSpec) error {
+	_, err := c.set.AppsV1().
+		Deployments(c.namespace).
+		Apply(ctx, c.genDeployment(name, project, spec), meta.ApplyOptions{FieldManager: FIELD_MANAGER})
+	if err != nil {
+		return fmt.Errorf("cannot apply deployment %v: %w", name, err)
+	}
+	return nil
+}
+
 func (c *KubeClient) DeleteDeployment(ctx context.Context, name string) error {
-	return c.set.AppsV1().Deployments(c.namespace).Delete(ctx, name, meta.DeleteOptions{})
+	err := c.set.AppsV1().Deployments(c.namespace).Delete(ctx, name, meta.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return fmt.Errorf("cannot delete deployment %v: %w", name, err)
+	}
+	return nil
+}
+
+func (c *KubeClient) DeleteService(ctx context.Context, name string) error {
+	err := c.set.CoreV1().Services(c.namespace).Delete(ctx, name, meta.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return fmt.Errorf("cannot delete service %v: %w", name, err)
+	}
+	return nil
 }
 
-func (c *KubeClient) WaitForEndpoint(ctx context.Context, name string) error {
-	selector := fmt.Sprintf("metadata.name=%s", name)
-	idx := 0
+type PodInfo struct {
+	Name     string
+	IP       string
+	Node     string
+	Phase    core.PodPhase
+	Ready    bool
+	Restarts int32
+	Started  time.Time
 
-	for {
-		if idx > 20 {
-			return fmt.Errorf("too many attempts (%v) to find service", idx)
+	Terminating bool
+}
+
+type SandboxInfo struct {
+	Name          string
+	Project       int64
+	Epoch         int64
+	Replicas      int32
+	ReadyReplicas int32
+	Created       time.Time
+	Terminating   bool
+	Pods          []PodInfo
+
+	// Idle sandboxes are scaled to zero, Replicas is then the count they boot back into.
+	Idle bool
+
+	// Version is the version the sandbox's replicas should serve, nil until one was accepted.
+	Version *int64
+
+	// Isolate runs each of the sandbox's processes in its own namespaces.
+	Isolate bool
+}
+
+type Endpoint struct {
+	Pod string
+	IP  string
+}
+
+var ErrSandboxNotFound = errors.New("sandbox not found")
+
+// ListSandboxes returns every sandbox deployment managed by fusion along with its pods.
+func (c *KubeClient) ListSandboxes() ([]SandboxInfo, error) {
+	deployments, err := c.deployments.Deployments(c.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("cannot list deployments: %w", err)
+	}
+
+	pods, err := c.listPods(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	sandboxes := make([]SandboxInfo, 0, len(deployments))
+	for _, deployment := range deployments {
+		sandbox, ok := sandboxInfo(deployment)
+		if !ok {
+			continue
+		}
+		sandbox.Pods = pods[sandbox.Name]
+		sandboxes = append(sandboxes, sandbox)
+	}
+
+	sort.Slice(sandboxes, func(i, j int) bool {
+		return sandboxes[i].Project < sandboxes[j].Project
+	})
+
+	return sandboxes, nil
+}
+
+func (c *KubeClient) GetSandbox(name string) (*SandboxInfo, error) {
+	deployment, err := c.deployments.Deployments(c.namespace).Get(name)
+	if kerrors.IsNotFound(err) {
+		return nil, ErrSandboxNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot get deployment %v: %w", name, err)
+	}
+
+	sandbox, ok := sandboxInfo(deployment)
+	if !ok {
+		return nil, ErrSandboxNotFound
+	}
+
+	pods, err := c.listPods(labels.SelectorFromSet(labels.Set{LABEL_NAME: name}))
+	if err != nil {
+		return nil, err
+	}
+	sandbox.Pods = pods[name]
+
+	return &sandbox, nil
+}
+
+// listPods returns the cached pods matching selector grouped by the name of their sandbox.
+func (c *KubeClient) listPods(selector labels.Selector) (map[string][]PodInfo, error) {
+	list, err := c.pods.Pods(c.namespace).List(selector)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list pods: %w", err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	pods := make(map[string][]PodInfo)
+	for _, pod := range list {
+		info := PodInfo{
+			Name:  pod.Name,
+			IP:    pod.Status.PodIP,
+			Node:  pod.Spec.NodeName,
+			Phase: pod.Status.Phase,
+
+			Terminating: pod.DeletionTimestamp != nil,
 		}
+		if pod.Status.StartTime != nil {
+			info.Started = pod.Status.StartTime.Time
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == core.PodReady {
+				info.Ready = condition.Status == core.ConditionTrue
+			}
+		}
+		for _, container := range pod.Status.ContainerStatuses {
+			info.Restarts += container.RestartCount
+		}
+
+		name := pod.Labels[LABEL_NAME]
+		pods[name] = append(pods[name], info)
+	}
 
-		list, err := c.set.CoreV1().
-			Endpoints(c.namespace).
-			List(ctx, meta.ListOptions{FieldSelector: selector})
+	return pods, nil
+}
+
+func sandboxInfo(deployment *apps.Deployment) (SandboxInfo, bool) {
+	project, err := strconv.ParseInt(deployment.Labels[LABEL_PROJECT], 10, 64)
+	if err != nil {
+		// Deployments created before the project label existed are only identified by their s-<project> name.
+		id, ok := strings.CutPrefix(deployment.Name, "s-")
+		if !ok {
+			return SandboxInfo{}, false
+		}
+
+		project, err = strconv.ParseInt(id, 10, 64)
 		if err != nil {
-			return fmt.Errorf("cannot list services %v: %w", name, err)
+			return SandboxInfo{}, false
 		}
+	}
 
-		if len(list.Items) > 0 {
-			endpoint := list.Items[0]
-			if len(endpoint.Subsets) > 0 {
-				return nil
-			}
+	epoch, _ := strconv.ParseInt(deployment.Labels[LABEL_EPOCH], 10, 64)
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	idle := false
+	if replicas == 0 {
+		idleReplicas, err := strconv.ParseInt(deployment.Annotations[ANNOTATION_REPLICAS], 10, 32)
+		if err == nil && idleReplicas > 0 {
+			replicas = int32(idleReplicas)
+			idle = true
 		}
+	}
 
-		time.Sleep(250 * time.Millisecond)
-		idx += 1
+	var version *int64
+	if parsed, err := strconv.ParseInt(deployment.Annotations[ANNOTATION_VERSION], 10, 64); err == nil {
+		version = &parsed
 	}
+
+	return SandboxInfo{
+		Name:          deployment.Name,
+		Project:       project,
+		Epoch:         epoch,
+		Replicas:      replicas,
+		ReadyReplicas: deployment.Status.ReadyReplicas,
+		Created:       deployment.CreationTimestamp.Time,
+		Terminating:   deployment.DeletionTimestamp != nil,
+		Idle:          idle,
+		Version:       version,
+		Isolate:       deployment.Annotations[ANNOTATION_ISOLATE] == "true",
+	}, true
 }
 
-func (c *KubeClient) GetAllEndpoints(ctx context.Context, name string) ([]string, error) {
-	selector := fmt.Sprintf("metadata.name=%s", name)
-	list, err := c.set.CoreV1().
-		Endpoints(c.namespace).
-		List(ctx, meta.ListOptions{FieldSelector: selector})
+// WaitForEndpoints blocks until the service of name has count ready endpoints, re-checking the cache
+// whenever it changes until ctx is done.
+func (c *KubeClient) WaitForEndpoints(ctx context.Context, name string, count int) error {
+	for {
+		changed := c.cacheChanged()
+
+		endpoints, err := c.GetAllEndpoints(name)
+		if err != nil {
+			return err
+		}
+		if len(endpoints) >= count {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cannot find %v ready endpoints for %v, found %v: %w", count, name, len(endpoints), ctx.Err())
+		case <-changed:
+		}
+	}
+}
+
+// GetAllEndpoints returns every ready pod behind the service of name, from the cached endpoint slices.
+func (c *KubeClient) GetAllEndpoints(name string) ([]Endpoint, error) {
+	slices, err := c.slices.EndpointSlices(c.namespace).
+		List(labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: name}))
 	if err != nil {
 		return nil, fmt.Errorf("cannot list endpoints of %v: %w", name, err)
 	}
 
-	ips := make([]string, len(list.Items))
-	for _, endpoint := range list.Items {
-		if len(endpoint.Subsets) > 0 {
-			if len(endpoint.Subsets[0].Addresses) > 0 {
-				ips = append(ips, endpoint.Subsets[0].Addresses[0].IP)
+	seen := make(map[string]bool)
+	endpoints := []Endpoint{}
+	for _, slice := range slices {
+		if slice.AddressType == discovery.AddressTypeFQDN {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
 			}
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+
+			// Dual stack services have a slice per address type, each pod is only reached once.
+			ready := Endpoint{IP: endpoint.Addresses[0]}
+			key := ready.IP
+			if endpoint.TargetRef != nil {
+				ready.Pod = endpoint.TargetRef.Name
+				key = ready.Pod
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			endpoints = append(endpoints, ready)
 		}
 	}
 
-	return ips, nil
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].IP < endpoints[j].IP
+	})
+	return endpoints, nil
 }
 
-func (c *KubeClient) genDeployment(name string, project int64) *appsconf.DeploymentApplyConfiguration {
+func (c *KubeClient) genDeployment(name string, project int64, spec SandboxSpec) *appsconf.DeploymentApplyConfiguration {
 	labels := map[string]string{
-		"fusion/type":  "node",
-		"fusion/name":  name,
-		"fusion/epoch": strconv.FormatInt(c.epoch, 10),
+		LABEL_TYPE:  "node",
+		LABEL_NAME:  name,
+		LABEL_EPOCH: strconv.FormatInt(c.epoch, 10),
+	}
+
+	replicas := spec.Replicas
+	annotations := map[string]string{}
+	if spec.Idle {
+		replicas = 0
+		annotations[ANNOTATION_REPLICAS] = strconv.FormatInt(int64(spec.Replicas), 10)
+	}
+	if spec.Version != nil {
+		annotations[ANNOTATION_VERSION] = strconv.FormatInt(*spec.Version, 10)
+	}
+	if spec.Isolate {
+		annotations[ANNOTATION_ISOLATE] = "true"
 	}
 
+	// The project label is kept out of the selector so that it can be added to existing deployments.
 	return appsconf.Deployment(name, c.namespace).
 		WithLabels(labels).
+		WithLabels(map[string]string{LABEL_PROJECT: strconv.FormatInt(project, 10)}).
+		WithAnnotations(annotations).
 		WithSpec(
 			appsconf.DeploymentSpec().
-				WithReplicas(1).
+				WithReplicas(replicas).
 				WithSelector(
 					metaconf.LabelSelector().
 						WithMatchLabels(labels),
@@ -138,7 +666,7 @@ func (c *KubeClient) genDeployment(name string, project int64) *appsconf.Deploym
 						WithLabels(labels).
 						WithSpec(
 							coreconf.PodSpec().
-								WithContainers(c.genContainer(project)).
+								WithContainers(c.genContainer(project, spec.Isolate)).
 								WithVolumes(
 									coreconf.Volume().
 										WithName("workdir").
@@ -154,10 +682,11 @@ func (c *KubeClient) genDeployment(name string, project int64) *appsconf.Deploym
 
 func (c *KubeClient) genService(name string) *coreconf.ServiceApplyConfiguration {
 	labels := map[string]string{
-		"fusion/name": name,
+		LABEL_NAME: name,
 	}
 
 	return coreconf.Service(name, c.namespace).
+		WithLabels(map[string]string{LABEL_TYPE: "node", LABEL_NAME: name}).
 		WithSpec(
 			coreconf.ServiceSpec().
 				WithSelector(labels).
@@ -165,21 +694,33 @@ func (c *KubeClient) genService(name string) *coreconf.ServiceApplyConfiguration
 					coreconf.ServicePort().
 						WithProtocol(core.ProtocolTCP).
 						WithPort(80).
-						WithTargetPort(intstr.FromInt(5152)),
+						WithTargetPort(intstr.FromInt(SANDBOX_PORT)),
 				),
 		)
 }
 
-func (c *KubeClient) genContainer(project int64) *coreconf.ContainerApplyConfiguration {
+func (c *KubeClient) genContainer(project int64, isolate bool) *coreconf.ContainerApplyConfiguration {
 	port := coreconf.ContainerPort().
-		WithContainerPort(5152)
+		WithName("proxy").
+		WithContainerPort(SANDBOX_PORT)
+
+	// The control port is reached by the manager on the pod's IP, it isn't part of the service.
+	controlPort := coreconf.ContainerPort().
+		WithName("control").
+		WithContainerPort(SANDBOX_CONTROL_PORT)
+
+	command := []string{"./fusion", "sandbox", "-p", strconv.Itoa(SANDBOX_PORT), "--control-port", strconv.Itoa(SANDBOX_CONTROL_PORT)}
+	if isolate {
+		command = append(command, "--isolate")
+	}
+	command = append(command, strconv.FormatInt(project, 10))
 
 	return coreconf.Container().
 		WithName("sandbox").
 		WithImage(c.image).
 		WithImagePullPolicy(core.PullNever).
-		WithPorts(port).
-		WithCommand("./fusion", "sandbox", "-p", "5152", strconv.FormatInt(project, 10)).
+		WithPorts(port, controlPort).
+		WithCommand(command...).
 		WithVolumeMounts(
 			coreconf.VolumeMount().
 				WithName("workdir").
@@ -0,0 +1,150 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/angelini/fusion/pkg/sandbox"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_IDLE_TTL = 15 * time.Minute
+	REAPER_INTERVAL  = time.Minute
+	REAPER_TIMEOUT   = 10 * time.Second
+)
+
+// reapIdle scales every sandbox that hasn't served a request for idleTTL to zero, podproxy boots them
+// again on their next request.
+func (m *ManagerApi) reapIdle(ctx context.Context) {
+	if m.idleTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(REAPER_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.reapOnce(ctx)
+	}
+}
+
+// reapOnce checks every sandbox in parallel, each within its own REAPER_TIMEOUT so that unreachable pods
+// can't hold up the others.
+func (m *ManagerApi) reapOnce(ctx context.Context) {
+	sandboxes, err := m.kubeClient.ListSandboxes()
+	if err != nil {
+		m.log.Warn("failed to list sandboxes to reap", zap.Error(err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, info := range sandboxes {
+		if info.Terminating || info.Idle {
+			continue
+		}
+
+		info := info
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.reapSandbox(ctx, &info)
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *ManagerApi) reapSandbox(ctx context.Context, info *SandboxInfo) {
+	ctx, cancel := context.WithTimeout(ctx, REAPER_TIMEOUT)
+	defer cancel()
+
+	log := m.log.With(zap.Int64("project", info.Project))
+
+	idle, version, err := m.sandboxIdle(ctx, info)
+	if err != nil {
+		log.Warn("failed to check if sandbox is idle", zap.Error(err))
+		return
+	}
+	if idle < m.idleTTL {
+		return
+	}
+
+	if info.Version != nil {
+		version = info.Version
+	}
+
+	log.Info("reap idle sandbox", zap.Duration("idle", idle), zap.Int64p("version", version))
+
+	err = m.kubeClient.IdleDeployment(ctx, info.Name, info.Project, SandboxSpec{Replicas: info.Replicas, Version: version, Isolate: info.Isolate})
+	if err != nil {
+		log.Warn("failed to reap idle sandbox", zap.Error(err))
+	}
+}
+
+// sandboxIdle returns how long the least idle replica of a sandbox has gone without a request and the
+// version it serves, sandboxes without ready replicas are still booting and never idle.
+func (m *ManagerApi) sandboxIdle(ctx context.Context, info *SandboxInfo) (time.Duration, *int64, error) {
+	idle := time.Duration(-1)
+	var version *int64
+
+	for _, pod := range info.Pods {
+		if !pod.Ready {
+			continue
+		}
+
+		status, err := m.sandboxStatus(ctx, info.Project, pod.IP)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		replicaIdle := time.Duration(status.IdleSeconds * float64(time.Second))
+		if idle == -1 || replicaIdle < idle {
+			idle = replicaIdle
+		}
+		if version == nil && status.Current != nil {
+			version = &status.Current.Version
+		}
+	}
+
+	if idle == -1 {
+		return 0, nil, nil
+	}
+	return idle, version, nil
+}
+
+func (m *ManagerApi) sandboxStatus(ctx context.Context, project int64, ip string) (*sandbox.Status, error) {
+	req, err := m.metaRequest(ctx, http.MethodGet, project, ip, "status", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("sandbox %v rejected status request (%v): %s", ip, resp.StatusCode, message)
+	}
+
+	var status sandbox.Status
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode status from %v: %w", ip, err)
+	}
+
+	return &status, nil
+}
@@ -1,7 +1,10 @@
 package manager
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/tls"
+	"fmt"
 	"time"
 
 	"github.com/angelini/fusion/internal/pb"
@@ -13,7 +16,7 @@ import (
 	"google.golang.org/grpc/credentials"
 )
 
-func NewServer(log *zap.Logger, cert *tls.Certificate, namespace, image, dlServer string) (*grpc.Server, error) {
+func NewServer(ctx context.Context, log *zap.Logger, cert *tls.Certificate, namespace, image, dlServer string, metaKey ed25519.PrivateKey, idleTTL time.Duration) (*grpc.Server, error) {
 	creds := credentials.NewServerTLSFromCert(cert)
 
 	grpcServer := grpc.NewServer(
@@ -32,11 +35,19 @@ func NewServer(log *zap.Logger, cert *tls.Certificate, namespace, image, dlServe
 		grpc.Creds(creds),
 	)
 
-	api, err := NewManagerApi(log, time.Now().Unix(), namespace, image, dlServer)
+	api, err := NewManagerApi(log, time.Now().Unix(), namespace, image, dlServer, metaKey, idleTTL)
 	if err != nil {
 		return nil, err
 	}
 
+	err = api.kubeClient.Start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start k8s caches: %w", err)
+	}
+
+	go api.reapIdle(ctx)
+	go api.convergeVersions(ctx)
+
 	pb.RegisterManagerServer(grpcServer, api)
 
 	return grpcServer, nil
@@ -0,0 +1,313 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/angelini/fusion/internal/pb"
+	"github.com/angelini/fusion/pkg/sandbox"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apps "k8s.io/api/apps/v1"
+	core "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	WATCH_BUFFER    = 64
+	WATCH_RETRY     = time.Second
+	WATCH_RETRY_MAX = 30 * time.Second
+)
+
+var sandboxEventTypes = map[sandbox.EventType]pb.SandboxEvent_Type{
+	sandbox.EVENT_REBUILD_STARTED:  pb.SandboxEvent_REBUILD_STARTED,
+	sandbox.EVENT_REBUILD_FINISHED: pb.SandboxEvent_REBUILD_FINISHED,
+	sandbox.EVENT_RELOADED:         pb.SandboxEvent_RELOADED,
+	sandbox.EVENT_HEALTHY:          pb.SandboxEvent_PROCESS_HEALTHY,
+	sandbox.EVENT_PROMOTED:         pb.SandboxEvent_PROCESS_PROMOTED,
+	sandbox.EVENT_DRAINED:          pb.SandboxEvent_PROCESS_DRAINED,
+	sandbox.EVENT_CRASHED:          pb.SandboxEvent_PROCESS_CRASHED,
+	sandbox.EVENT_START_FAILED:     pb.SandboxEvent_PROCESS_START_FAILED,
+}
+
+// sandboxWatcher turns the cached changes to a sandbox's deployment, pods and endpoints into events, and
+// follows the process events of every ready pod. Its state is only touched by the subscription goroutine.
+type sandboxWatcher struct {
+	log     *zap.Logger
+	api     *ManagerApi
+	name    string
+	project int64
+	start   time.Time
+	events  chan *pb.SandboxEvent
+
+	generation int64
+	scheduled  map[string]bool
+	followers  map[string]context.CancelFunc
+}
+
+// WatchSandbox streams the lifecycle events of project's sandbox until the client disconnects. Kubernetes
+// events start with the current state of the sandbox's resources, process events with those emitted since
+// the watch started.
+func (m *ManagerApi) WatchSandbox(req *pb.WatchSandboxRequest, stream pb.Manager_WatchSandboxServer) error {
+	m.log.Info("watch sandbox", zap.Int64("project", req.Project))
+	ctx := stream.Context()
+	name := m.name(req.Project)
+
+	w := &sandboxWatcher{
+		log:       m.log.With(zap.Int64("project", req.Project)),
+		api:       m,
+		name:      name,
+		project:   req.Project,
+		start:     time.Now(),
+		events:    make(chan *pb.SandboxEvent, WATCH_BUFFER),
+		scheduled: make(map[string]bool),
+		followers: make(map[string]context.CancelFunc),
+	}
+
+	subscription, err := m.kubeClient.Subscribe(name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Manager failed to watch %v: %v", name, err)
+	}
+	defer m.kubeClient.Unsubscribe(subscription)
+
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	group.Go(func() error {
+		for {
+			event, err := subscription.Next(groupCtx)
+			if err != nil {
+				return nil
+			}
+
+			switch event.Object.(type) {
+			case *apps.Deployment:
+				w.deploymentChanged(groupCtx, event)
+			case *core.Pod:
+				w.podChanged(groupCtx, event)
+			case *discovery.EndpointSlice:
+				w.endpointsChanged(groupCtx)
+			}
+		}
+	})
+
+	group.Go(func() error {
+		for {
+			select {
+			case <-groupCtx.Done():
+				return nil
+			case event := <-w.events:
+				err := stream.Send(event)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	})
+
+	err = group.Wait()
+	if err != nil && ctx.Err() == nil {
+		return status.Errorf(codes.Internal, "Manager failed to watch %v: %v", name, err)
+	}
+
+	return nil
+}
+
+func nextRetry(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > WATCH_RETRY_MAX {
+		return WATCH_RETRY_MAX
+	}
+	return delay
+}
+
+func (w *sandboxWatcher) send(ctx context.Context, event *pb.SandboxEvent) {
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().UnixNano()
+	}
+
+	select {
+	case <-ctx.Done():
+	case w.events <- event:
+	}
+}
+
+func (w *sandboxWatcher) deploymentChanged(ctx context.Context, event watch.Event) {
+	deployment, ok := event.Object.(*apps.Deployment)
+	if !ok {
+		return
+	}
+
+	if event.Type == watch.Deleted {
+		w.generation = 0
+		w.send(ctx, &pb.SandboxEvent{Type: pb.SandboxEvent_DEPLOYMENT_DELETED, Message: deployment.Name})
+		return
+	}
+
+	if deployment.Generation == w.generation {
+		return
+	}
+	w.generation = deployment.Generation
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	w.send(ctx, &pb.SandboxEvent{
+		Type:    pb.SandboxEvent_DEPLOYMENT_APPLIED,
+		Message: fmt.Sprintf("%v generation %v with %v replicas", deployment.Name, deployment.Generation, replicas),
+	})
+}
+
+func (w *sandboxWatcher) podChanged(ctx context.Context, event watch.Event) {
+	pod, ok := event.Object.(*core.Pod)
+	if !ok {
+		return
+	}
+
+	if event.Type == watch.Deleted {
+		delete(w.scheduled, pod.Name)
+		w.send(ctx, &pb.SandboxEvent{Type: pb.SandboxEvent_POD_DELETED, Pod: pod.Name, Ip: pod.Status.PodIP})
+		return
+	}
+
+	if w.scheduled[pod.Name] {
+		return
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodScheduled && condition.Status == core.ConditionTrue {
+			w.scheduled[pod.Name] = true
+
+			event := &pb.SandboxEvent{Type: pb.SandboxEvent_POD_SCHEDULED, Pod: pod.Name, Message: pod.Spec.NodeName}
+			if !condition.LastTransitionTime.IsZero() {
+				event.Timestamp = condition.LastTransitionTime.UnixNano()
+			}
+			w.send(ctx, event)
+		}
+	}
+}
+
+// endpointsChanged reports addresses joining and leaving the sandbox's service, and follows the process
+// events of each ready address. A service's endpoints span several slices, so they're read back from the cache.
+func (w *sandboxWatcher) endpointsChanged(ctx context.Context) {
+	endpoints, err := w.api.kubeClient.GetAllEndpoints(w.name)
+	if err != nil {
+		w.log.Warn("failed to read endpoints", zap.Error(err))
+		return
+	}
+
+	ready := make(map[string]string)
+	for _, endpoint := range endpoints {
+		ready[endpoint.IP] = endpoint.Pod
+	}
+
+	for ip, pod := range ready {
+		if _, ok := w.followers[ip]; ok {
+			continue
+		}
+
+		followCtx, cancel := context.WithCancel(ctx)
+		w.followers[ip] = cancel
+
+		w.send(ctx, &pb.SandboxEvent{Type: pb.SandboxEvent_ENDPOINT_READY, Pod: pod, Ip: ip})
+		go w.followProcesses(followCtx, pod, ip)
+	}
+
+	for ip, cancel := range w.followers {
+		if _, ok := ready[ip]; ok {
+			continue
+		}
+
+		cancel()
+		delete(w.followers, ip)
+		w.send(ctx, &pb.SandboxEvent{Type: pb.SandboxEvent_ENDPOINT_REMOVED, Ip: ip})
+	}
+}
+
+// followProcesses streams the process events of the sandbox pod at ip, reconnecting with exponential
+// backoff until ctx is done.
+func (w *sandboxWatcher) followProcesses(ctx context.Context, pod, ip string) {
+	since := w.start
+	delay := WATCH_RETRY
+
+	for {
+		err := w.api.followSandboxEvents(ctx, w.project, ip, since, func(event *sandbox.Event) {
+			since = event.At.Add(time.Nanosecond)
+			delay = WATCH_RETRY
+
+			eventType, ok := sandboxEventTypes[event.Type]
+			if !ok {
+				return
+			}
+
+			w.send(ctx, &pb.SandboxEvent{
+				Type:      eventType,
+				Timestamp: event.At.UnixNano(),
+				Pod:       pod,
+				Ip:        ip,
+				Version:   &event.Version,
+				Port:      int32(event.Port),
+				Message:   event.Message,
+			})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.log.Warn("failed to follow sandbox events", zap.String("ip", ip), zap.Duration("delay", delay), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay = nextRetry(delay)
+	}
+}
+
+func (m *ManagerApi) followSandboxEvents(ctx context.Context, project int64, ip string, since time.Time, handle func(*sandbox.Event)) error {
+	query := url.Values{}
+	query.Set("follow", "true")
+	query.Set("since", since.Format(time.RFC3339Nano))
+
+	req, err := m.metaRequest(ctx, http.MethodGet, project, ip, "events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("sandbox %v rejected events request (%v): %s", ip, resp.StatusCode, message)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event sandbox.Event
+		err := decoder.Decode(&event)
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode event from %v: %w", ip, err)
+		}
+
+		handle(&event)
+	}
+}
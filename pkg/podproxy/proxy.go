@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/angelini/fusion/internal/pb"
+	"github.com/angelini/fusion/internal/upgrade"
 	"github.com/o1egl/paseto"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -22,6 +25,7 @@ import (
 
 const (
 	PROXY_REQUEST_TIMEOUT = 10 * time.Second
+	PROXY_CONNECT_TIMEOUT = 5 * time.Second
 )
 
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
@@ -43,8 +47,9 @@ type Proxy struct {
 	port       int
 	publicKey  ed25519.PublicKey
 
-	httpClient    *http.Client
-	managerClient pb.ManagerClient
+	httpClient       *http.Client
+	upgradeTransport *http.Transport
+	managerClient    pb.ManagerClient
 }
 
 func NewProxy(log *zap.Logger, namespace, managerUri string, port int, publicKey ed25519.PublicKey) (*Proxy, error) {
@@ -62,6 +67,13 @@ func NewProxy(log *zap.Logger, namespace, managerUri string, port int, publicKey
 		Timeout: PROXY_REQUEST_TIMEOUT,
 	}
 
+	// Upgraded connections are long lived, so they only get a connect timeout.
+	upgradeTransport := http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: PROXY_CONNECT_TIMEOUT,
+		}).DialContext,
+	}
+
 	return &Proxy{
 		log:        log,
 		namespace:  namespace,
@@ -69,8 +81,9 @@ func NewProxy(log *zap.Logger, namespace, managerUri string, port int, publicKey
 		port:       port,
 		publicKey:  publicKey,
 
-		httpClient:    &httpClient,
-		managerClient: managerClient,
+		httpClient:       &httpClient,
+		upgradeTransport: &upgradeTransport,
+		managerClient:    managerClient,
 	}, nil
 }
 
@@ -98,37 +111,76 @@ func (p *Proxy) Start(ctx context.Context) error {
 
 		_, err = net.LookupIP(hostname)
 		if err != nil {
-			_, err = p.managerClient.BootSandbox(ctx, &pb.BootSandboxRequest{
-				Project: project,
-			})
+			err = p.bootSandbox(ctx, project)
 			if err != nil {
 				p.httpErr(resp, err, "failed to boot sandbox")
 				return
 			}
 		}
 
+		protocol := upgrade.Type(req.Header)
+		if protocol != "" {
+			p.proxyUpgrade(resp, req, hostname, protocol)
+			return
+		}
+
 		body, err := io.ReadAll(req.Body)
 		if err != nil {
 			p.httpErr(resp, err, "failed to read proxy request body")
 			return
 		}
 
-		url := fmt.Sprintf("http://%s%s", hostname, req.URL.String())
-		proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
-		if err != nil {
-			p.httpErr(resp, err, "failed to create proxy request")
-			return
+		// Only a request that never got a connection is sent again after booting the sandbox, so that
+		// non-idempotent requests are never delivered twice.
+		connected := false
+		trace := &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) {
+				connected = true
+			},
 		}
 
-		proxyReq.Header = make(http.Header)
-		copyHeader(proxyReq.Header, req.Header, true)
+		url := fmt.Sprintf("http://%s%s", hostname, req.URL.String())
+		newProxyReq := func() (*http.Request, error) {
+			proxyReq, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), req.Method, url, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+
+			proxyReq.Header = make(http.Header)
+			copyHeader(proxyReq.Header, req.Header, true)
+			return proxyReq, nil
+		}
 
 		remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
 		if err == nil {
 			appendHostToXForwardHeader(req.Header, remoteHost)
 		}
 
+		proxyReq, err := newProxyReq()
+		if err != nil {
+			p.httpErr(resp, err, "failed to create proxy request")
+			return
+		}
+
 		proxyResp, err := p.httpClient.Do(proxyReq)
+
+		// Idle sandboxes are scaled to zero, their service resolves but refuses connections.
+		if !connected && isDialErr(err) {
+			p.log.Info("sandbox unreachable, booting", zap.Int64("project", project), zap.Error(err))
+
+			err = p.bootSandbox(ctx, project)
+			if err != nil {
+				p.httpErr(resp, err, "failed to boot sandbox")
+				return
+			}
+
+			proxyReq, err = newProxyReq()
+			if err != nil {
+				p.httpErr(resp, err, "failed to create proxy request")
+				return
+			}
+			proxyResp, err = p.httpClient.Do(proxyReq)
+		}
 		if err != nil {
 			p.httpErr(resp, err, "failed to proxy request")
 			return
@@ -143,11 +195,62 @@ func (p *Proxy) Start(ctx context.Context) error {
 	return http.ListenAndServe(":"+strconv.Itoa(p.port), nil)
 }
 
+func (p *Proxy) bootSandbox(ctx context.Context, project int64) error {
+	_, err := p.managerClient.BootSandbox(ctx, &pb.BootSandboxRequest{
+		Project: project,
+	})
+	return err
+}
+
+func (p *Proxy) proxyUpgrade(resp http.ResponseWriter, req *http.Request, hostname, protocol string) {
+	url := fmt.Sprintf("http://%s%s", hostname, req.URL.RequestURI())
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, url, http.NoBody)
+	if err != nil {
+		p.httpErr(resp, err, "failed to create upgrade request")
+		return
+	}
+
+	proxyReq.Header = make(http.Header)
+	copyHeader(proxyReq.Header, req.Header, true)
+	proxyReq.Header.Set("Connection", "Upgrade")
+	proxyReq.Header.Set("Upgrade", protocol)
+
+	remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err == nil {
+		appendHostToXForwardHeader(proxyReq.Header, remoteHost)
+	}
+
+	proxyResp, err := p.upgradeTransport.RoundTrip(proxyReq)
+	if err != nil {
+		p.httpErr(resp, err, "failed to proxy upgrade request")
+		return
+	}
+	defer proxyResp.Body.Close()
+
+	if proxyResp.StatusCode != http.StatusSwitchingProtocols {
+		copyHeader(resp.Header(), proxyResp.Header, true)
+		resp.WriteHeader(proxyResp.StatusCode)
+		io.Copy(resp, proxyResp.Body)
+		return
+	}
+
+	err = upgrade.Splice(resp, proxyResp)
+	if err != nil {
+		p.log.Warn("upgraded connection closed", zap.String("url", url), zap.String("upgrade", protocol), zap.Error(err))
+	}
+}
+
 func (p *Proxy) httpErr(resp http.ResponseWriter, err error, message string) {
 	p.log.Error(message, zap.Error(err))
 	http.Error(resp, err.Error(), http.StatusInternalServerError)
 }
 
+// isDialErr reports whether err comes from connecting to the sandbox, before any of the request was written.
+func isDialErr(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
 func copyHeader(dest, src http.Header, skipHopHeaders bool) {
 	for key, value := range src {
 		if skipHopHeaders {
@@ -0,0 +1,185 @@
+package sandbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Limits are written verbatim to the cgroup v2 interface files, for example "512M" for memory.max,
+// "50000 100000" for cpu.max and "256" for pids.max. Empty limits are left at the kernel default.
+type Limits struct {
+	MemoryMax string
+	CPUMax    string
+	PidsMax   string
+}
+
+type Cgroup struct {
+	path string
+}
+
+// EnableControllers delegates the memory, cpu and pids controllers to the children of root.
+// The parent of root must already have them enabled in its cgroup.subtree_control.
+func EnableControllers(root string) error {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create cgroup root %v: %w", root, err)
+	}
+
+	err = os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+memory +cpu +pids"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to enable cgroup controllers in %v: %w", root, err)
+	}
+
+	return nil
+}
+
+func NewCgroup(root, name string, limits Limits) (*Cgroup, error) {
+	path := filepath.Join(root, name)
+
+	err := os.Mkdir(path, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %v: %w", path, err)
+	}
+
+	cgroup := &Cgroup{path: path}
+
+	for file, value := range map[string]string{
+		"memory.max": limits.MemoryMax,
+		"cpu.max":    limits.CPUMax,
+		"pids.max":   limits.PidsMax,
+	} {
+		if value == "" {
+			continue
+		}
+
+		err = cgroup.write(file, value)
+		if err != nil {
+			cgroup.Remove()
+			return nil, err
+		}
+	}
+
+	return cgroup, nil
+}
+
+// Kill sends SIGKILL to every process in the cgroup, including those that left the process group.
+func (g *Cgroup) Kill() error {
+	return g.write("cgroup.kill", "1")
+}
+
+// OOMKilled reports whether the kernel OOM killer terminated a process in the cgroup.
+func (g *Cgroup) OOMKilled() bool {
+	events, err := g.readKeyed("memory.events")
+	if err != nil {
+		return false
+	}
+	return events["oom_kill"] > 0
+}
+
+// Remove deletes the cgroup, which only succeeds once every process in it has exited.
+func (g *Cgroup) Remove() error {
+	err := os.Remove(g.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove cgroup %v: %w", g.path, err)
+	}
+	return nil
+}
+
+type CgroupStats struct {
+	MemoryBytes     int64 `json:"memoryBytes"`
+	MemoryPeakBytes int64 `json:"memoryPeakBytes,omitempty"`
+	CPUUsageUsec    int64 `json:"cpuUsageUsec"`
+	Pids            int64 `json:"pids"`
+	OOMKills        int64 `json:"oomKills"`
+}
+
+func (g *Cgroup) Stats() (*CgroupStats, error) {
+	var stats CgroupStats
+	var err error
+
+	stats.MemoryBytes, err = g.readInt("memory.current")
+	if err != nil {
+		return nil, err
+	}
+
+	// memory.peak is only available on Linux 5.19+
+	stats.MemoryPeakBytes, _ = g.readInt("memory.peak")
+
+	cpu, err := g.readKeyed("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	stats.CPUUsageUsec = cpu["usage_usec"]
+
+	stats.Pids, err = g.readInt("pids.current")
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := g.readKeyed("memory.events")
+	if err != nil {
+		return nil, err
+	}
+	stats.OOMKills = events["oom_kill"]
+
+	return &stats, nil
+}
+
+func (g *Cgroup) write(file, value string) error {
+	path := filepath.Join(g.path, file)
+
+	err := os.WriteFile(path, []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %v to %v: %w", value, path, err)
+	}
+	return nil
+}
+
+func (g *Cgroup) readInt(file string) (int64, error) {
+	path := filepath.Join(g.path, file)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %v: %w", path, err)
+	}
+
+	value, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %v: %w", path, err)
+	}
+	return value, nil
+}
+
+// readKeyed parses flat keyed files such as memory.events and cpu.stat.
+func (g *Cgroup) readKeyed(file string) (map[string]int64, error) {
+	path := filepath.Join(g.path, file)
+
+	handle, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", path, err)
+	}
+	defer handle.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = value
+	}
+
+	return values, scanner.Err()
+}
@@ -0,0 +1,20 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// attach makes cmd start inside the cgroup with CLONE_INTO_CGROUP, so that nothing it forks can escape the
+// limits. The returned directory must be closed once the command started.
+func (g *Cgroup) attach(cmd *exec.Cmd) (*os.File, error) {
+	dir, err := os.Open(g.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cgroup %v: %w", g.path, err)
+	}
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return dir, nil
+}
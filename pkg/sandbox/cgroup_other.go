@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func (g *Cgroup) attach(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("cgroups are only supported on linux")
+}
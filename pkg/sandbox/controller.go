@@ -2,9 +2,14 @@ package sandbox
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	dlc "github.com/gadget-inc/dateilager/pkg/client"
@@ -12,24 +17,80 @@ import (
 )
 
 const (
-	NEXT_PROCESS_HEALTHY_INTERVAL = 500 * time.Millisecond
-	OLD_PROCESS_GRACEFUL_INTERVAL = 2 * time.Second
-	CHECK_LIVE_PORT_INTERVAL      = 100 * time.Millisecond
-
 	MAX_PORT_OFFSET = 500
+
+	DEFAULT_HEALTH_PATH   = "/health"
+	DEFAULT_STOP_SIGNAL   = syscall.SIGTERM
+	DEFAULT_STOP_TIMEOUT  = 10 * time.Second
+	DEFAULT_RESTART       = RESTART_ON_FAILURE
+	DEFAULT_START_TIMEOUT = time.Minute
 )
 
 type Command struct {
-	Exec    string
-	Args    []string
-	WorkDir string
+	Exec         string
+	Args         []string
+	WorkDir      string
+	Env          map[string]string
+	HealthPath   string
+	PortEnv      string
+	StopSignal   syscall.Signal
+	StopTimeout  time.Duration
+	Restart      RestartPolicy
+	StartTimeout time.Duration
+
+	RestartPatterns []string
+	ReloadSignal    syscall.Signal
+	ReloadPath      string
 }
 
 func NewCommand(exec string, args []string, workDir string) Command {
 	return Command{
-		Exec:    exec,
-		Args:    args,
-		WorkDir: workDir,
+		Exec:         exec,
+		Args:         args,
+		WorkDir:      workDir,
+		HealthPath:   DEFAULT_HEALTH_PATH,
+		StopSignal:   DEFAULT_STOP_SIGNAL,
+		StopTimeout:  DEFAULT_STOP_TIMEOUT,
+		Restart:      DEFAULT_RESTART,
+		StartTimeout: DEFAULT_START_TIMEOUT,
+	}
+}
+
+// Options configures how a Controller routes traffic between its processes.
+type Options struct {
+	// ZeroDowntime keeps the current process serving while the next one boots, instead of holding
+	// requests until the next process is promoted.
+	ZeroDowntime bool
+
+	// SocketDir switches processes from TCP ports to Unix domain sockets created in this directory.
+	SocketDir string
+
+	// CgroupRoot places each process in its own cgroup v2 under this directory, constrained by Limits.
+	CgroupRoot string
+	Limits     Limits
+
+	// Isolation runs untrusted project code in new namespaces, nil runs it directly in the sandbox.
+	Isolation *Isolation
+
+	// Follow polls DateiLager every FollowInterval and deploys the project's latest version once it has been
+	// stable for FollowDebounce.
+	Follow         bool
+	FollowInterval time.Duration
+	FollowDebounce time.Duration
+
+	// MaxQueueDepth and MaxQueueWait bound the requests waiting for a live process, MaxConcurrency bounds
+	// the in-flight requests of each process. Zero disables a limit.
+	MaxQueueDepth  int
+	MaxQueueWait   time.Duration
+	MaxConcurrency int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		FollowInterval: DEFAULT_FOLLOW_INTERVAL,
+		FollowDebounce: DEFAULT_FOLLOW_DEBOUNCE,
+		MaxQueueDepth:  DEFAULT_MAX_QUEUE_DEPTH,
+		MaxQueueWait:   DEFAULT_MAX_QUEUE_WAIT,
 	}
 }
 
@@ -37,21 +98,77 @@ type Controller struct {
 	Host string
 
 	log        *zap.Logger
+	options    Options
 	command    Command
-	portStart  int
-	portOffset int
+	ports      *PortAllocator
+	workDirs   *WorkDirs
 	project    int64
 	dlClient   *dlc.Client
+	ctx        context.Context
 	cancelFunc context.CancelFunc
 
+	// checkTransport is shared by the health checks and reload notifications sent to processes, so that
+	// their idle connections are reused instead of leaking one transport per start.
+	checkTransport *http.Transport
+
+	// startMutex serializes StartProcess calls, so a newer version always replaces an older next.
+	startMutex sync.Mutex
+
+	logs   *LogHub
+	events *EventLog
+
 	procMutex sync.RWMutex
+	changed   chan struct{}
 	counters  map[int]int
+	upgrades  map[int]int
+	queue     []*waiter
 	current   *Process
 	next      *Process
 	gracefuls []*Process
+	history   []*Process
+	crashErr  error
+
+	// restarts counts the consecutive crashes of restartsVersion.
+	restarts        int
+	restartsVersion int64
+
+	// warm processes serve requests pinned to their version and the share of traffic split to them.
+	warm   map[int64]*Process
+	split  map[int64]int
+	random *rand.Rand
+
+	lastFailure *StartFailure
+
+	// spawned counts the processes created, it keeps cgroup names unique when a version reuses a port.
+	spawned int
+
+	// lastRequest is when a request was last acquired or released, used to report the sandbox as idle.
+	lastRequest time.Time
+}
+
+// StartFailure records a version that never became healthy.
+type StartFailure struct {
+	Version int64     `json:"version"`
+	Port    int       `json:"port"`
+	Reason  string    `json:"reason"`
+	Stderr  []string  `json:"stderr"`
+	At      time.Time `json:"at"`
 }
 
-func NewController(parentCtx context.Context, log *zap.Logger, host, dlServer string, project int64, command Command, portStart int) (*Controller, error) {
+func (f *StartFailure) Error() string {
+	message := fmt.Sprintf("version %v failed to start: %v", f.Version, f.Reason)
+	if len(f.Stderr) > 0 {
+		message += "\n" + strings.Join(f.Stderr, "\n")
+	}
+	return message
+}
+
+var (
+	ErrNoCurrentProcess = errors.New("no current process")
+	ErrDrained          = errors.New("sandbox was drained")
+)
+
+func NewController(parentCtx context.Context, log *zap.Logger, host, dlServer string, project int64, command Command, portStart int, options Options) (*Controller, error) {
 	ctx, cancel := context.WithCancel(parentCtx)
 
 	dlClient, err := dlc.NewClient(ctx, dlServer)
@@ -60,233 +177,444 @@ func NewController(parentCtx context.Context, log *zap.Logger, host, dlServer st
 		return nil, err
 	}
 
-	controller := &Controller{
-		Host:      host,
-		log:       log,
-		command:   command,
-		portStart: portStart,
-		project:   project,
-		dlClient:  dlClient,
-
-		cancelFunc: cancel,
-		counters:   make(map[int]int),
-	}
-
-	go func() {
-		client := &http.Client{}
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				nextPort := controller.getNextPort()
-				if nextPort == -1 {
-					time.Sleep(NEXT_PROCESS_HEALTHY_INTERVAL)
-					continue
-				}
-
-				url := fmt.Sprintf("http://%s:%d/health", host, nextPort)
-				resp, err := client.Get(url)
-				if err != nil {
-					log.Info("could not connect", zap.String("url", url))
-					time.Sleep(NEXT_PROCESS_HEALTHY_INTERVAL)
-					continue
-				}
-
-				if resp.StatusCode == http.StatusOK {
-					log.Info("successful connection, upgrading to current", zap.String("url", url))
-					controller.setCurrent(nextPort)
-				}
-			}
+	if options.Isolation != nil {
+		err = options.Isolation.validate(options)
+		if err != nil {
+			cancel()
+			return nil, err
 		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				for _, oldProc := range controller.gracefuls {
-					if controller.remainingRequests(oldProc.port) == 0 {
-						oldProc.Kill()
-						controller.removeGraceful(oldProc.port)
-					}
-				}
-				time.Sleep(OLD_PROCESS_GRACEFUL_INTERVAL)
-			}
+	}
+
+	if options.CgroupRoot != "" {
+		err = EnableControllers(options.CgroupRoot)
+		if err != nil {
+			cancel()
+			return nil, err
 		}
-	}()
+	}
+
+	workDirs, err := NewWorkDirs(log, command.WorkDir)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	controller := &Controller{
+		Host:     host,
+		log:      log,
+		options:  options,
+		command:  command,
+		ports:    NewPortAllocator(host, portStart, MAX_PORT_OFFSET, options.SocketDir),
+		workDirs: workDirs,
+		project:  project,
+		dlClient: dlClient,
+
+		ctx:         ctx,
+		cancelFunc:  cancel,
+		logs:        NewLogHub(),
+		events:      NewEventLog(),
+		changed:     make(chan struct{}),
+		counters:    make(map[int]int),
+		upgrades:    make(map[int]int),
+		lastRequest: time.Now(),
+		warm:        make(map[int64]*Process),
+		split:       make(map[int64]int),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	controller.checkTransport = controller.Transport(HEALTH_TIMEOUT)
+
+	go controller.checkLiveness()
+	if options.Follow {
+		go controller.follow()
+	}
 
 	return controller, nil
 }
 
 func (c *Controller) Close() {
-	c.procMutex.Lock()
-	defer c.procMutex.Unlock()
+	c.cancelFunc()
+	c.checkTransport.CloseIdleConnections()
 
+	c.procMutex.Lock()
+	procs := append(c.warmLocked(), c.gracefuls...)
 	if c.next != nil {
-		c.next.Kill()
+		procs = append(procs, c.next)
 	}
-
 	if c.current != nil {
-		c.current.Kill()
+		procs = append(procs, c.current)
 	}
+	c.procMutex.Unlock()
 
-	for _, oldProc := range c.gracefuls {
-		oldProc.Kill()
+	var wg sync.WaitGroup
+	for _, proc := range procs {
+		proc := proc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proc.Kill()
+		}()
 	}
-
-	c.cancelFunc()
+	wg.Wait()
 }
 
-func (c *Controller) remainingRequests(port int) int {
-	c.procMutex.RLock()
-	defer c.procMutex.RUnlock()
+// newProcessLocked allocates a free port for a new process and pins its workdir until it exits.
+func (c *Controller) newProcessLocked(command Command, version int64) (*Process, error) {
+	port, err := c.ports.Allocate()
+	if err != nil {
+		return nil, err
+	}
 
-	return c.counters[port]
-}
+	proc := NewProcess(c.log, c.logs, command, port, c.ports.Socket(port), version)
+	if c.options.Isolation != nil {
+		proc.isolation = c.options.Isolation.forProcess(c.workDirs.root, c.options.SocketDir, proc.socket)
+	}
 
-func (c *Controller) removeGraceful(port int) {
-	c.procMutex.Lock()
-	defer c.procMutex.Unlock()
+	c.spawned += 1
 
-	for index, oldProc := range c.gracefuls {
-		if oldProc.port == port {
-			c.gracefuls = append(c.gracefuls[:index], c.gracefuls[index+1:]...)
-			return
+	if c.options.CgroupRoot != "" {
+		proc.cgroup, err = NewCgroup(c.options.CgroupRoot, fmt.Sprintf("v%d-p%d-%d", version, port, c.spawned), c.options.Limits)
+		if err != nil {
+			c.ports.Release(port)
+			return nil, err
 		}
 	}
+
+	c.workDirs.Acquire(command.WorkDir)
+	return proc, nil
 }
 
-func (c *Controller) getNextPort() int {
+// Stats reports the state and resource usage of every running process.
+func (c *Controller) Stats() []ProcessStats {
 	c.procMutex.RLock()
-	defer c.procMutex.RUnlock()
-
-	if c.next == nil {
-		return -1
+	procs := append([]*Process{}, c.gracefuls...)
+	if c.current != nil {
+		procs = append(procs, c.current)
 	}
-
-	return c.next.port
-}
-
-func (c *Controller) killNextIfRunning() error {
-	c.procMutex.Lock()
-	defer c.procMutex.Unlock()
-
 	if c.next != nil {
-		err := c.next.Kill()
+		procs = append(procs, c.next)
+	}
+	procs = append(procs, c.warmLocked()...)
+
+	stats := make([]ProcessStats, len(procs))
+	for idx, proc := range procs {
+		stats[idx] = ProcessStats{
+			Port:      proc.port,
+			Version:   proc.version,
+			State:     proc.state,
+			Pid:       proc.cmd.Process.Pid,
+			StartedAt: proc.startedAt,
+			Exit:      proc.ExitStatus(),
+		}
+	}
+	c.procMutex.RUnlock()
+
+	for idx, proc := range procs {
+		usage, err := proc.Stats()
 		if err != nil {
-			return err
+			c.log.Warn("failed to read process stats", zap.Int("port", proc.port), zap.Error(err))
+			continue
 		}
-		c.next = nil
+		stats[idx].Cgroup = usage
 	}
 
-	return nil
+	return stats
 }
 
-func (c *Controller) setNext(proc *Process) {
-	c.procMutex.Lock()
-	defer c.procMutex.Unlock()
+// Transport returns an HTTP transport that dials processes by port, whether they listen on TCP or on a
+// Unix domain socket.
+func (c *Controller) Transport(connectTimeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext: c.ports.DialContext(&net.Dialer{
+			Timeout: connectTimeout,
+		}),
+	}
+}
+
+// StartProcess hot reloads the current process when the target version allows it, otherwise it rebuilds the
+// version into its own workdir, boots it as the next process and waits for it to be promoted. If it doesn't
+// become healthy within its start timeout it is killed and the current process keeps serving. A warm process
+// of the target version is promoted without booting a new one.
+func (c *Controller) StartProcess(ctx context.Context, targetVersion *int64) (int64, error) {
+	proc, err := c.startProcess(ctx, targetVersion)
+	if err != nil {
+		return -1, err
+	}
 
-	c.next = proc
+	err = c.awaitPromotion(ctx, proc)
+	if err != nil {
+		return proc.Version(), err
+	}
+
+	return proc.Version(), nil
 }
 
-func (c *Controller) setCurrent(port int) {
+func (c *Controller) startProcess(ctx context.Context, targetVersion *int64) (*Process, error) {
+	c.startMutex.Lock()
+	defer c.startMutex.Unlock()
+
 	c.procMutex.Lock()
-	defer c.procMutex.Unlock()
+	// Concurrent requests for the same version, such as a burst of boots, all wait for the same process.
+	if c.next != nil && targetVersion != nil && c.next.version == *targetVersion {
+		proc := c.next
+		c.procMutex.Unlock()
+		return proc, nil
+	}
 
-	// Test if we're attempting to set an older 'next' as 'current'.
-	if c.next.port != port {
-		return
+	if c.next != nil {
+		c.log.Info("replacing pending next process", zap.Int("port", c.next.port), zap.Int64("version", c.next.version))
+		c.stopLocked(c.next)
+		c.next = nil
 	}
 
-	if c.current != nil {
-		c.gracefuls = append(c.gracefuls, c.current)
+	if targetVersion != nil {
+		proc := c.promoteWarmLocked(*targetVersion)
+		if proc != nil {
+			c.procMutex.Unlock()
+			return proc, nil
+		}
 	}
+	c.procMutex.Unlock()
 
-	c.current = c.next
-	c.next = nil
-}
+	proc, err := c.reload(ctx, targetVersion)
+	if err != nil || proc != nil {
+		return proc, err
+	}
 
-func (c *Controller) StartProcess(ctx context.Context, targetVersion *int64) (int64, error) {
-	err := c.killNextIfRunning()
+	c.emitRebuildStarted(targetVersion)
+	workDir, version, err := c.workDirs.Build(ctx, c.dlClient, c.project, targetVersion)
 	if err != nil {
-		return -1, fmt.Errorf("failed to kill concurrent next process: %w", err)
+		c.events.Emit(EVENT_START_FAILED, -1, 0, err.Error())
+		return nil, err
 	}
+	c.events.Emit(EVENT_REBUILD_FINISHED, version, 0, workDir)
 
-	c.portOffset += 1
-	if c.portOffset > MAX_PORT_OFFSET {
-		c.portOffset = 0
+	command, err := LoadCommand(workDir, c.command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load command for version %v: %w", version, err)
 	}
-	port := c.portStart + c.portOffset
 
-	version, _, err := c.dlClient.Rebuild(ctx, c.project, "", targetVersion, c.command.WorkDir, "/tmp")
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	proc, err = c.newProcessLocked(command, version)
 	if err != nil {
-		return -1, fmt.Errorf("failed to rebuild workdir to version %v: %w", version, err)
+		return nil, err
 	}
 
-	proc := NewProcess(c.log, c.command.Exec, c.command.Args[0], port, version)
-
-	err = proc.Run(ctx)
+	err = c.startNextLocked(proc)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	c.setNext(proc)
-	return version, nil
+	return proc, nil
 }
 
-func (c *Controller) IncrementRequestCounter(port int) {
-	c.procMutex.Lock()
-	defer c.procMutex.Unlock()
+func (c *Controller) awaitPromotion(ctx context.Context, proc *Process) error {
+	for {
+		c.procMutex.RLock()
+		state := proc.state
+		failure := proc.failure
+		changed := c.changed
+		c.procMutex.RUnlock()
+
+		switch state {
+		case STATE_CURRENT, STATE_DRAINING:
+			return nil
+		case STATE_FAILED, STATE_STOPPED:
+			if failure != nil {
+				return failure
+			}
+			return fmt.Errorf("version %v was replaced before becoming healthy", proc.version)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Restart boots a new process for the current version and swaps to it like a new version.
+func (c *Controller) Restart(ctx context.Context) (int64, error) {
+	version := c.currentVersion()
+	if version == -1 {
+		return -1, ErrNoCurrentProcess
+	}
 
-	c.counters[port] += 1
+	return c.StartProcess(ctx, &version)
 }
 
-func (c *Controller) DecrementRequestCounter(port int) {
+// Drain stops routing requests to the sandbox's processes and waits for them to exit once their in-flight
+// requests complete. Requests fail with ErrDrained until the next version is started.
+func (c *Controller) Drain(ctx context.Context) error {
+	c.startMutex.Lock()
+	defer c.startMutex.Unlock()
+
 	c.procMutex.Lock()
-	defer c.procMutex.Unlock()
+	var procs []*Process
+	if c.next != nil {
+		procs = append(procs, c.next)
+		c.stopLocked(c.next)
+		c.next = nil
+	}
+	if c.current != nil {
+		old := c.current
+		c.current = nil
+		c.gracefuls = append(c.gracefuls, old)
+		c.setStateLocked(old, STATE_DRAINING)
+		go c.drain(old)
+	}
+	for _, proc := range c.warmLocked() {
+		c.removeWarmLocked(proc)
+		c.gracefuls = append(c.gracefuls, proc)
+		c.setStateLocked(proc, STATE_DRAINING)
+		go c.drain(proc)
+	}
+	c.crashErr = ErrDrained
+	c.broadcastLocked()
+
+	procs = append(procs, c.gracefuls...)
+	c.procMutex.Unlock()
 
-	c.counters[port] -= 1
+	c.log.Info("draining sandbox", zap.Int("processes", len(procs)))
 
-	if c.counters[port] == 0 {
-		delete(c.counters, port)
+	for {
+		c.procMutex.RLock()
+		stopped := true
+		for _, proc := range procs {
+			if proc.state != STATE_STOPPED && proc.state != STATE_FAILED {
+				stopped = false
+			}
+		}
+		changed := c.changed
+		c.procMutex.RUnlock()
+
+		if stopped {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
 	}
 }
 
-func (c *Controller) sendLivePort(portChan chan int) bool {
+type ProcessStatus struct {
+	Port          int          `json:"port"`
+	Version       int64        `json:"version"`
+	State         ProcessState `json:"state"`
+	Pid           int          `json:"pid"`
+	InFlight      int          `json:"inFlight"`
+	StartedAt     time.Time    `json:"startedAt"`
+	UptimeSeconds float64      `json:"uptimeSeconds"`
+}
+
+type Status struct {
+	Current     *ProcessStatus  `json:"current"`
+	Next        *ProcessStatus  `json:"next"`
+	Gracefuls   []ProcessStatus `json:"gracefuls"`
+	Warm        []ProcessStatus `json:"warm"`
+	Split       map[int64]int   `json:"split"`
+	Queued      int             `json:"queued"`
+	InFlight    int             `json:"inFlight"`
+	IdleSeconds float64         `json:"idleSeconds"`
+	Restarts    int             `json:"restarts"`
+	Follow      bool            `json:"follow"`
+	Error       string          `json:"error,omitempty"`
+	LastFailure *StartFailure   `json:"lastFailure,omitempty"`
+}
+
+// Status reports which processes are serving, booting and draining, without reading their cgroups.
+func (c *Controller) Status() Status {
 	c.procMutex.RLock()
 	defer c.procMutex.RUnlock()
 
-	if c.next == nil && c.current != nil {
-		portChan <- c.current.port
-		return true
+	processStatus := func(proc *Process) ProcessStatus {
+		return ProcessStatus{
+			Port:          proc.port,
+			Version:       proc.version,
+			State:         proc.state,
+			Pid:           proc.cmd.Process.Pid,
+			InFlight:      c.counters[proc.port],
+			StartedAt:     proc.startedAt,
+			UptimeSeconds: time.Since(proc.startedAt).Seconds(),
+		}
+	}
+
+	status := Status{
+		Gracefuls:   make([]ProcessStatus, len(c.gracefuls)),
+		Split:       make(map[int64]int, len(c.split)),
+		Queued:      len(c.queue),
+		InFlight:    c.inFlightLocked(),
+		IdleSeconds: c.idleLocked().Seconds(),
+		Restarts:    c.restarts,
+		Follow:      c.options.Follow,
+		LastFailure: c.lastFailure,
+	}
+
+	if c.current != nil {
+		current := processStatus(c.current)
+		status.Current = &current
+	}
+	if c.next != nil {
+		next := processStatus(c.next)
+		status.Next = &next
+	}
+	for idx, proc := range c.gracefuls {
+		status.Gracefuls[idx] = processStatus(proc)
+	}
+	for _, proc := range c.warmLocked() {
+		status.Warm = append(status.Warm, processStatus(proc))
+	}
+	for version, weight := range c.split {
+		status.Split[version] = weight
 	}
-	return false
+	if c.crashErr != nil {
+		status.Error = c.crashErr.Error()
+	}
+
+	return status
 }
 
-func (c *Controller) LivePortChannel(ctx context.Context) chan int {
-	portChan := make(chan int, 1)
-	foundPort := c.sendLivePort(portChan)
+// logBuffers returns the log buffers of every running and recently exited process, along with a channel
+// that is closed when the set of processes changes.
+func (c *Controller) logBuffers() ([]*LogBuffer, <-chan struct{}) {
+	c.procMutex.RLock()
+	defer c.procMutex.RUnlock()
 
-	if !foundPort {
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					if c.sendLivePort(portChan) {
-						return
-					} else {
-						time.Sleep(CHECK_LIVE_PORT_INTERVAL)
-					}
-				}
-			}
-		}()
+	var buffers []*LogBuffer
+	for _, proc := range c.history {
+		buffers = append(buffers, proc.logs)
+	}
+	for _, proc := range c.gracefuls {
+		buffers = append(buffers, proc.logs)
+	}
+	if c.current != nil {
+		buffers = append(buffers, c.current.logs)
 	}
+	if c.next != nil {
+		buffers = append(buffers, c.next.logs)
+	}
+	for _, proc := range c.warmLocked() {
+		buffers = append(buffers, proc.logs)
+	}
+
+	return buffers, c.changed
+}
+
+// LastFailure returns the most recent version that failed to start, if any.
+func (c *Controller) LastFailure() *StartFailure {
+	c.procMutex.RLock()
+	defer c.procMutex.RUnlock()
+
+	return c.lastFailure
+}
 
-	return portChan
+// IsStartFailure reports whether err was caused by a version that never became healthy.
+func IsStartFailure(err error) bool {
+	var failure *StartFailure
+	return errors.As(err, &failure)
 }
@@ -0,0 +1,24 @@
+package sandbox
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStartProcessReusesPendingNext(t *testing.T) {
+	c := newQueueController(Options{}, currentProcess(1, 1))
+	next := &Process{port: 2, version: 2, state: STATE_STARTING}
+	c.next = next
+
+	version := int64(2)
+	proc, err := c.startProcess(context.Background(), &version)
+	if err != nil {
+		t.Fatalf("failed to start process: %v", err)
+	}
+	if proc != next || c.next != next {
+		t.Fatalf("expected the pending next process to be reused")
+	}
+	if next.state != STATE_STARTING {
+		t.Fatalf("expected the pending next process to keep starting, got %v", next.state)
+	}
+}
@@ -0,0 +1,156 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	EVENT_BUFFER_SIZE = 500
+)
+
+type EventType string
+
+const (
+	EVENT_REBUILD_STARTED  EventType = "rebuild_started"
+	EVENT_REBUILD_FINISHED EventType = "rebuild_finished"
+	EVENT_RELOADED         EventType = "reloaded"
+	EVENT_HEALTHY          EventType = "healthy"
+	EVENT_PROMOTED         EventType = "promoted"
+	EVENT_DRAINED          EventType = "drained"
+	EVENT_CRASHED          EventType = "crashed"
+	EVENT_START_FAILED     EventType = "start_failed"
+)
+
+// Event is a lifecycle change of the sandbox's processes, Version is -1 when it isn't known yet.
+type Event struct {
+	Seq     uint64    `json:"seq"`
+	At      time.Time `json:"at"`
+	Type    EventType `json:"type"`
+	Version int64     `json:"version"`
+	Port    int       `json:"port"`
+	Message string    `json:"message,omitempty"`
+}
+
+// EventLog is a bounded ring of the most recent events that wakes followers when events are emitted.
+type EventLog struct {
+	mutex   sync.Mutex
+	seq     uint64
+	events  []Event
+	start   int
+	changed chan struct{}
+}
+
+func NewEventLog() *EventLog {
+	return &EventLog{
+		events:  make([]Event, 0, EVENT_BUFFER_SIZE),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *EventLog) Emit(eventType EventType, version int64, port int, message string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.seq += 1
+	event := Event{
+		Seq:     l.seq,
+		At:      time.Now(),
+		Type:    eventType,
+		Version: version,
+		Port:    port,
+		Message: message,
+	}
+
+	if len(l.events) < cap(l.events) {
+		l.events = append(l.events, event)
+	} else {
+		l.events[l.start] = event
+		l.start = (l.start + 1) % len(l.events)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns the buffered events after seq emitted at or after at, and a channel that is closed when
+// the next event is emitted.
+func (l *EventLog) since(at time.Time, after uint64) ([]Event, <-chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var events []Event
+	for idx := 0; idx < len(l.events); idx++ {
+		event := l.events[(l.start+idx)%len(l.events)]
+		if event.Seq <= after || event.At.Before(at) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, l.changed
+}
+
+// serveEvents writes events as newline delimited JSON, following streams keep the response open and flush
+// events as they're emitted. It accepts the since query of the logs endpoint and an after sequence number,
+// for resuming a stream.
+func serveEvents(log *zap.Logger, controller *Controller, resp http.ResponseWriter, req *http.Request) {
+	query, err := ParseLogQuery(req)
+	if err != nil {
+		writeMetaErr(log, resp, http.StatusBadRequest, err)
+		return
+	}
+
+	var after uint64
+	if value := req.URL.Query().Get("after"); value != "" {
+		after, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeMetaErr(log, resp, http.StatusBadRequest, fmt.Errorf("invalid after %v", value))
+			return
+		}
+	}
+
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	resp.WriteHeader(http.StatusOK)
+
+	flusher, _ := resp.(http.Flusher)
+	encoder := json.NewEncoder(resp)
+
+	for {
+		events, changed := controller.events.since(query.Since, after)
+		for _, event := range events {
+			err = encoder.Encode(event)
+			if err != nil {
+				log.Info("event follower disconnected", zap.Error(err))
+				return
+			}
+			after = event.Seq
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if !query.Follow {
+			return
+		}
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+func (c *Controller) emitRebuildStarted(targetVersion *int64) {
+	version := int64(-1)
+	if targetVersion != nil {
+		version = *targetVersion
+	}
+	c.events.Emit(EVENT_REBUILD_STARTED, version, 0, "")
+}
@@ -0,0 +1,75 @@
+package sandbox
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_FOLLOW_INTERVAL = 500 * time.Millisecond
+	DEFAULT_FOLLOW_DEBOUNCE = time.Second
+)
+
+// follow polls DateiLager for the project's latest version and deploys it once no newer version has been
+// written for FollowDebounce, so that a burst of writes only restarts the process once.
+func (c *Controller) follow() {
+	log := c.log.With(zap.Int64("project", c.project))
+	log.Info("following latest version", zap.Duration("interval", c.options.FollowInterval), zap.Duration("debounce", c.options.FollowDebounce))
+
+	deployed := int64(-1)
+	pending := int64(-1)
+	var pendingAt time.Time
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.options.FollowInterval):
+		}
+
+		inspect, err := c.dlClient.Inspect(c.ctx, c.project)
+		if err != nil {
+			log.Warn("failed to fetch latest version", zap.Error(err))
+			continue
+		}
+
+		latest := inspect.LatestVersion
+		if latest == deployed || latest == c.currentVersion() {
+			deployed = latest
+			pending = -1
+			continue
+		}
+
+		if latest != pending {
+			pending = latest
+			pendingAt = time.Now()
+			continue
+		}
+
+		if time.Since(pendingAt) < c.options.FollowDebounce {
+			continue
+		}
+
+		log.Info("deploying latest version", zap.Int64("version", latest))
+
+		// Failed versions aren't retried, the next write will produce a new version to deploy.
+		deployed = latest
+		pending = -1
+
+		_, err = c.StartProcess(c.ctx, &latest)
+		if err != nil {
+			log.Error("failed to deploy latest version", zap.Int64("version", latest), zap.Error(err))
+		}
+	}
+}
+
+func (c *Controller) currentVersion() int64 {
+	c.procMutex.RLock()
+	defer c.procMutex.RUnlock()
+
+	if c.current == nil {
+		return -1
+	}
+	return c.current.version
+}
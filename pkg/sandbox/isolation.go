@@ -0,0 +1,96 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	INIT_COMMAND    = "sandbox-init"
+	INIT_CONFIG_ENV = "FUSION_SANDBOX_INIT"
+)
+
+// Isolation runs each process in new mount and PID namespaces, and optionally a new network namespace,
+// with a read-only view of its workdir, a private scratch directory and a restricted environment.
+type Isolation struct {
+	// Network gives each process an empty network namespace, it can then only be reached through
+	// Unix domain sockets so Options.SocketDir must be set.
+	Network bool
+
+	// ScratchDir is mounted as a private tmpfs and exported as TMPDIR.
+	ScratchDir string
+
+	// HidePaths are covered by an empty read-only tmpfs, for credentials mounted into the sandbox.
+	HidePaths []string
+
+	// EnvAllowlist lists the sandbox environment variables passed through to the process.
+	EnvAllowlist []string
+
+	// readOnlyPaths and writablePaths are set per process by forProcess.
+	readOnlyPaths []string
+	writablePaths []string
+}
+
+func DefaultIsolation() *Isolation {
+	return &Isolation{
+		ScratchDir:   "/tmp/fusion-scratch",
+		HidePaths:    []string{"/var/run/secrets", "/home/main/secrets"},
+		EnvAllowlist: []string{"PATH", "HOME", "LANG", "LC_ALL", "TZ"},
+	}
+}
+
+// forProcess returns a copy of the isolation that also locks down the directories every process shares:
+// the workdirs of all versions and the socket dir are read-only, except for the process's own socket dir.
+func (i *Isolation) forProcess(workDirRoot, socketDir, socket string) *Isolation {
+	isolation := *i
+	isolation.readOnlyPaths = []string{workDirRoot}
+	isolation.writablePaths = nil
+
+	if socketDir != "" {
+		isolation.readOnlyPaths = append(isolation.readOnlyPaths, socketDir)
+		isolation.writablePaths = []string{filepath.Dir(socket)}
+	}
+
+	return &isolation
+}
+
+// initConfig is passed from the sandbox to the init process through INIT_CONFIG_ENV.
+type initConfig struct {
+	WorkDir       string   `json:"workDir"`
+	ScratchDir    string   `json:"scratchDir"`
+	HidePaths     []string `json:"hidePaths"`
+	ReadOnlyPaths []string `json:"readOnlyPaths"`
+	WritablePaths []string `json:"writablePaths"`
+}
+
+func (i *Isolation) validate(options Options) error {
+	if i.Network && options.SocketDir == "" {
+		return fmt.Errorf("network isolation requires a socket dir")
+	}
+	return nil
+}
+
+// environ returns the allowed subset of the sandbox's environment, DL_TOKEN and other platform
+// credentials are never passed through unless explicitly allowed.
+func (i *Isolation) environ() []string {
+	allowed := make(map[string]bool, len(i.EnvAllowlist))
+	for _, key := range i.EnvAllowlist {
+		allowed[key] = true
+	}
+
+	var env []string
+	for _, entry := range os.Environ() {
+		key, _, _ := strings.Cut(entry, "=")
+		if allowed[key] {
+			env = append(env, entry)
+		}
+	}
+
+	if i.ScratchDir != "" {
+		env = append(env, fmt.Sprintf("TMPDIR=%s", i.ScratchDir))
+	}
+
+	return env
+}
@@ -0,0 +1,371 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// wrap rewrites cmd to start through the sandbox init process inside new namespaces.
+func (i *Isolation) wrap(cmd *exec.Cmd) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find sandbox executable: %w", err)
+	}
+
+	config, err := json.Marshal(initConfig{
+		WorkDir:       cmd.Dir,
+		ScratchDir:    i.ScratchDir,
+		HidePaths:     i.HidePaths,
+		ReadOnlyPaths: i.readOnlyPaths,
+		WritablePaths: i.writablePaths,
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = append([]string{self, INIT_COMMAND, "--", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", INIT_CONFIG_ENV, config))
+
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+	if i.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	cmd.SysProcAttr.Cloneflags = flags
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+
+	return nil
+}
+
+// RunInit is PID 1 of an isolated process: it prepares the mount namespace, locks down privileges,
+// starts the user command, forwards stop signals to it and reaps orphans until it exits.
+func RunInit(args []string) (int, error) {
+	if len(args) == 0 {
+		return 1, errors.New("missing command to run")
+	}
+
+	var config initConfig
+	err := json.Unmarshal([]byte(os.Getenv(INIT_CONFIG_ENV)), &config)
+	if err != nil {
+		return 1, fmt.Errorf("failed to parse init config: %w", err)
+	}
+	os.Unsetenv(INIT_CONFIG_ENV)
+
+	// no_new_privs and seccomp filters apply to the calling thread, the user command must be forked from it.
+	runtime.LockOSThread()
+
+	err = setupMounts(config)
+	if err != nil {
+		return 1, err
+	}
+
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return 1, fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+
+	err = installSeccomp()
+	if err != nil {
+		return 1, err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = config.WorkDir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return 1, fmt.Errorf("cannot start process %v: %w", args, err)
+	}
+
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	// As PID 1 every orphan is re-parented to us, reap them all until the user command exits.
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return 1, fmt.Errorf("failed to wait for process: %w", err)
+		}
+
+		if pid != cmd.Process.Pid {
+			continue
+		}
+
+		if status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return status.ExitStatus(), nil
+	}
+}
+
+func setupMounts(config initConfig) error {
+	err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	// Writable paths are bound first so they stay writable when a parent is remounted read-only.
+	for _, path := range config.WritablePaths {
+		err = unix.Mount(path, path, "", unix.MS_BIND, "")
+		if err != nil {
+			return fmt.Errorf("failed to bind %v: %w", path, err)
+		}
+	}
+
+	for _, path := range config.ReadOnlyPaths {
+		err = bindReadOnly(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.ScratchDir != "" {
+		err = os.MkdirAll(config.ScratchDir, 0700)
+		if err != nil {
+			return fmt.Errorf("failed to create scratch dir %v: %w", config.ScratchDir, err)
+		}
+
+		err = unix.Mount("tmpfs", config.ScratchDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0700")
+		if err != nil {
+			return fmt.Errorf("failed to mount scratch dir %v: %w", config.ScratchDir, err)
+		}
+	}
+
+	for _, path := range config.HidePaths {
+		_, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		err = unix.Mount("tmpfs", path, "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "size=4k")
+		if err != nil {
+			return fmt.Errorf("failed to hide %v: %w", path, err)
+		}
+	}
+
+	err = unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+
+	return nil
+}
+
+// bindReadOnly remounts path read-only, keeping the flags of the original mount which can't be cleared
+// from inside a user namespace.
+func bindReadOnly(path string) error {
+	err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind %v: %w", path, err)
+	}
+
+	var stat unix.Statfs_t
+	err = unix.Statfs(path, &stat)
+	if err != nil {
+		return fmt.Errorf("failed to stat %v: %w", path, err)
+	}
+
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	for statFlag, mountFlag := range map[int64]uintptr{
+		unix.ST_NOSUID:      unix.MS_NOSUID,
+		unix.ST_NODEV:       unix.MS_NODEV,
+		unix.ST_NOEXEC:      unix.MS_NOEXEC,
+		unix.ST_NOATIME:     unix.MS_NOATIME,
+		unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+		unix.ST_RELATIME:    unix.MS_RELATIME,
+		unix.ST_SYNCHRONOUS: unix.MS_SYNCHRONOUS,
+	} {
+		if stat.Flags&statFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+
+	err = unix.Mount("", path, "", flags, "")
+	if err != nil {
+		return fmt.Errorf("failed to remount %v read-only: %w", path, err)
+	}
+
+	return nil
+}
+
+// deniedSyscalls can be used to escape or tamper with the sandbox, they fail with EPERM.
+var deniedSyscalls = []uint32{
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_FSOPEN,
+	unix.SYS_FSCONFIG,
+	unix.SYS_FSMOUNT,
+	unix.SYS_FSPICK,
+	unix.SYS_MOVE_MOUNT,
+	unix.SYS_OPEN_TREE,
+	unix.SYS_MOUNT_SETATTR,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_PTRACE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_IO_URING_SETUP,
+	unix.SYS_IO_URING_ENTER,
+	unix.SYS_IO_URING_REGISTER,
+}
+
+// cloneNamespaceFlags are the clone flags that create new namespaces, clone calls passing any of them
+// fail with EPERM like unshare.
+const cloneNamespaceFlags = unix.CLONE_NEWUSER | unix.CLONE_NEWNS | unix.CLONE_NEWPID | unix.CLONE_NEWNET |
+	unix.CLONE_NEWUTS | unix.CLONE_NEWIPC | unix.CLONE_NEWCGROUP
+
+var auditArches = map[string]uint32{
+	"amd64": 0xc000003e, // AUDIT_ARCH_X86_64
+	"arm64": 0xc00000b7, // AUDIT_ARCH_AARCH64
+}
+
+const (
+	seccompDataNr   = 0  // offsetof(struct seccomp_data, nr)
+	seccompDataArch = 4  // offsetof(struct seccomp_data, arch)
+	seccompDataArg0 = 16 // offsetof(struct seccomp_data, args[0]), the low half on little-endian arches
+
+	// x32 syscalls are reported with the x86_64 audit arch and __X32_SYSCALL_BIT set in their number.
+	x32SyscallBit = 0x40000000
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+)
+
+// seccompTarget is where a filter instruction jumps, either the next instruction or one of the returns
+// appended after the comparisons.
+type seccompTarget int
+
+const (
+	seccompNext seccompTarget = iota
+	seccompAllow
+	seccompDeny
+	seccompNoSys
+	seccompKill
+)
+
+type seccompInstruction struct {
+	code   uint16
+	k      uint32
+	jt, jf seccompTarget
+}
+
+func installSeccomp() error {
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp is not supported on %v", runtime.GOARCH)
+	}
+
+	program := []seccompInstruction{
+		{code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, k: seccompDataArch},
+		{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: arch, jf: seccompKill},
+		{code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, k: seccompDataNr},
+		{code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, k: x32SyscallBit, jt: seccompKill},
+	}
+	for _, nr := range deniedSyscalls {
+		program = append(program, seccompInstruction{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: nr, jt: seccompDeny})
+	}
+
+	// clone3 passes its flags in a struct the filter can't read, libc falls back to clone on ENOSYS.
+	program = append(program,
+		seccompInstruction{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: unix.SYS_CLONE3, jt: seccompNoSys},
+		seccompInstruction{code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, k: unix.SYS_CLONE, jf: seccompAllow},
+		seccompInstruction{code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, k: seccompDataArg0},
+		seccompInstruction{code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, k: cloneNamespaceFlags, jt: seccompDeny, jf: seccompAllow},
+	)
+
+	filter, err := assembleSeccomp(program)
+	if err != nil {
+		return err
+	}
+
+	fprog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	err = unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to install seccomp filter: %w", err)
+	}
+
+	return nil
+}
+
+// assembleSeccomp resolves the jump targets of program into relative offsets and appends the returns.
+func assembleSeccomp(program []seccompInstruction) ([]unix.SockFilter, error) {
+	returns := map[seccompTarget]uint32{
+		seccompAllow: seccompRetAllow,
+		seccompDeny:  seccompRetErrno | uint32(unix.EPERM),
+		seccompNoSys: seccompRetErrno | uint32(unix.ENOSYS),
+		seccompKill:  seccompRetKillProcess,
+	}
+
+	offset := func(idx int, target seccompTarget) (uint8, error) {
+		if target == seccompNext {
+			return 0, nil
+		}
+		jump := len(program) - idx - 1 + int(target-seccompAllow)
+		if jump > 255 {
+			return 0, fmt.Errorf("seccomp jump of %v instructions is out of range", jump)
+		}
+		return uint8(jump), nil
+	}
+
+	filter := make([]unix.SockFilter, 0, len(program)+len(returns))
+	for idx, instruction := range program {
+		jt, err := offset(idx, instruction.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := offset(idx, instruction.jf)
+		if err != nil {
+			return nil, err
+		}
+
+		filter = append(filter, unix.SockFilter{Code: instruction.code, Jt: jt, Jf: jf, K: instruction.k})
+	}
+
+	for target := seccompAllow; target <= seccompKill; target++ {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: returns[target]})
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func (i *Isolation) wrap(cmd *exec.Cmd) error {
+	return errors.New("process isolation is only supported on linux")
+}
+
+func RunInit(args []string) (int, error) {
+	return 1, errors.New("process isolation is only supported on linux")
+}
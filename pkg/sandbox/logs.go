@@ -0,0 +1,248 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	LOG_BUFFER_LINES = 1000
+	PROCESS_HISTORY  = 5
+
+	STREAM_STDOUT = "stdout"
+	STREAM_STDERR = "stderr"
+)
+
+type LogLine struct {
+	Seq     uint64    `json:"seq"`
+	At      time.Time `json:"at"`
+	Stream  string    `json:"stream"`
+	Port    int       `json:"port"`
+	Version int64     `json:"version"`
+	Message string    `json:"message"`
+}
+
+// LogBuffer is a bounded ring of the most recent lines written by one process.
+// It is guarded by the LogHub it was created with.
+type LogBuffer struct {
+	hub   *LogHub
+	lines []LogLine
+	start int
+}
+
+// LogHub orders lines across every process's buffer and wakes followers when lines are appended.
+type LogHub struct {
+	mutex   sync.Mutex
+	seq     uint64
+	changed chan struct{}
+}
+
+func NewLogHub() *LogHub {
+	return &LogHub{
+		changed: make(chan struct{}),
+	}
+}
+
+func (h *LogHub) NewBuffer() *LogBuffer {
+	return &LogBuffer{
+		hub:   h,
+		lines: make([]LogLine, 0, LOG_BUFFER_LINES),
+	}
+}
+
+func (b *LogBuffer) Append(line LogLine) {
+	h := b.hub
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.seq += 1
+	line.Seq = h.seq
+
+	if len(b.lines) < cap(b.lines) {
+		b.lines = append(b.lines, line)
+	} else {
+		b.lines[b.start] = line
+		b.start = (b.start + 1) % len(b.lines)
+	}
+
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Lines returns the buffered lines in order, filtered by stream if it isn't empty.
+func (b *LogBuffer) Lines(stream string) []LogLine {
+	b.hub.mutex.Lock()
+	defer b.hub.mutex.Unlock()
+
+	return b.linesLocked(stream, time.Time{}, 0)
+}
+
+func (b *LogBuffer) linesLocked(stream string, since time.Time, after uint64) []LogLine {
+	var lines []LogLine
+	for idx := 0; idx < len(b.lines); idx++ {
+		line := b.lines[(b.start+idx)%len(b.lines)]
+		if line.Seq <= after || line.At.Before(since) {
+			continue
+		}
+		if stream != "" && line.Stream != stream {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// collect merges the lines of every buffer, ordered by sequence, and returns a channel that is closed
+// when the next line is appended.
+func (h *LogHub) collect(buffers []*LogBuffer, since time.Time, after uint64) ([]LogLine, <-chan struct{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var lines []LogLine
+	for _, buffer := range buffers {
+		lines = append(lines, buffer.linesLocked("", since, after)...)
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].Seq < lines[j].Seq
+	})
+
+	return lines, h.changed
+}
+
+type LogQuery struct {
+	Tail   int
+	Since  time.Time
+	Follow bool
+}
+
+// ParseLogQuery reads tail (line count), since (RFC 3339 timestamp or a duration such as "5m")
+// and follow from the URL query.
+func ParseLogQuery(req *http.Request) (LogQuery, error) {
+	var query LogQuery
+	values := req.URL.Query()
+
+	if tail := values.Get("tail"); tail != "" {
+		parsed, err := strconv.Atoi(tail)
+		if err != nil || parsed < 0 {
+			return query, fmt.Errorf("invalid tail %v", tail)
+		}
+		query.Tail = parsed
+	}
+
+	if since := values.Get("since"); since != "" {
+		at, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			duration, durationErr := time.ParseDuration(since)
+			if durationErr != nil {
+				return query, fmt.Errorf("invalid since %v: expected a timestamp or duration", since)
+			}
+			at = time.Now().Add(-duration)
+		}
+		query.Since = at
+	}
+
+	if follow := values.Get("follow"); follow != "" {
+		parsed, err := strconv.ParseBool(follow)
+		if err != nil {
+			return query, fmt.Errorf("invalid follow %v", follow)
+		}
+		query.Follow = parsed
+	}
+
+	return query, nil
+}
+
+// serveLogs writes log lines as newline delimited JSON, or as server-sent events if the client accepts
+// text/event-stream. Following streams keep the response open and flush lines as they're written.
+func serveLogs(log *zap.Logger, controller *Controller, resp http.ResponseWriter, req *http.Request) {
+	query, err := ParseLogQuery(req)
+	if err != nil {
+		writeMetaErr(log, resp, http.StatusBadRequest, err)
+		return
+	}
+
+	sse := req.Header.Get("Accept") == "text/event-stream"
+	if sse {
+		resp.Header().Set("Content-Type", "text/event-stream")
+		resp.Header().Set("Cache-Control", "no-cache")
+	} else {
+		resp.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	resp.WriteHeader(http.StatusOK)
+
+	flusher, _ := resp.(http.Flusher)
+	encoder := json.NewEncoder(resp)
+
+	write := func(lines []LogLine) error {
+		for _, line := range lines {
+			if sse {
+				_, err := fmt.Fprint(resp, "data: ")
+				if err != nil {
+					return err
+				}
+			}
+
+			err := encoder.Encode(line)
+			if err != nil {
+				return err
+			}
+
+			if sse {
+				_, err := fmt.Fprint(resp, "\n")
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	buffers, stateChanged := controller.logBuffers()
+	lines, logsChanged := controller.logs.collect(buffers, query.Since, 0)
+	if query.Tail > 0 && len(lines) > query.Tail {
+		lines = lines[len(lines)-query.Tail:]
+	}
+
+	var after uint64
+	if len(lines) > 0 {
+		after = lines[len(lines)-1].Seq
+	}
+
+	err = write(lines)
+	if err != nil || !query.Follow {
+		return
+	}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-logsChanged:
+		case <-stateChanged:
+		}
+
+		buffers, stateChanged = controller.logBuffers()
+		lines, logsChanged = controller.logs.collect(buffers, query.Since, after)
+		if len(lines) > 0 {
+			after = lines[len(lines)-1].Seq
+		}
+
+		err = write(lines)
+		if err != nil {
+			log.Info("log follower disconnected", zap.Error(err))
+			return
+		}
+	}
+}
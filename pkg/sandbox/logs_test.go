@@ -0,0 +1,123 @@
+package sandbox
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLogBufferKeepsLatestLines(t *testing.T) {
+	buffer := NewLogHub().NewBuffer()
+
+	total := LOG_BUFFER_LINES + 5
+	for idx := 0; idx < total; idx++ {
+		stream := STREAM_STDOUT
+		if idx%2 == 1 {
+			stream = STREAM_STDERR
+		}
+		buffer.Append(LogLine{Stream: stream})
+	}
+
+	lines := buffer.Lines("")
+	if len(lines) != LOG_BUFFER_LINES {
+		t.Fatalf("expected %v lines, got %v", LOG_BUFFER_LINES, len(lines))
+	}
+	for idx, line := range lines {
+		expected := uint64(total - LOG_BUFFER_LINES + idx + 1)
+		if line.Seq != expected {
+			t.Fatalf("expected line %v to have seq %v, got %v", idx, expected, line.Seq)
+		}
+	}
+
+	stderr := buffer.Lines(STREAM_STDERR)
+	if len(stderr) != LOG_BUFFER_LINES/2 {
+		t.Fatalf("expected %v stderr lines, got %v", LOG_BUFFER_LINES/2, len(stderr))
+	}
+	for _, line := range stderr {
+		if line.Stream != STREAM_STDERR {
+			t.Fatalf("expected only stderr lines, got %v", line.Stream)
+		}
+	}
+}
+
+func TestLogHubCollectsBuffersInOrder(t *testing.T) {
+	hub := NewLogHub()
+	first, second := hub.NewBuffer(), hub.NewBuffer()
+
+	start := time.Now()
+	first.Append(LogLine{At: start, Message: "a"})
+	second.Append(LogLine{At: start.Add(time.Second), Message: "b"})
+	first.Append(LogLine{At: start.Add(2 * time.Second), Message: "c"})
+
+	cases := []struct {
+		name     string
+		since    time.Time
+		after    uint64
+		expected []string
+	}{
+		{name: "all", expected: []string{"a", "b", "c"}},
+		{name: "since", since: start.Add(time.Second), expected: []string{"b", "c"}},
+		{name: "after", after: 2, expected: []string{"c"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			lines, _ := hub.collect([]*LogBuffer{first, second}, tc.since, tc.after)
+			if len(lines) != len(tc.expected) {
+				t.Fatalf("expected %v lines, got %v", len(tc.expected), len(lines))
+			}
+			for idx, line := range lines {
+				if line.Message != tc.expected[idx] {
+					t.Fatalf("expected line %v to be %v, got %v", idx, tc.expected[idx], line.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestLogHubWakesFollowers(t *testing.T) {
+	hub := NewLogHub()
+	buffer := hub.NewBuffer()
+
+	_, changed := hub.collect([]*LogBuffer{buffer}, time.Time{}, 0)
+	select {
+	case <-changed:
+		t.Fatalf("expected no change before a line is appended")
+	default:
+	}
+
+	buffer.Append(LogLine{Message: "a"})
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("expected appending a line to wake followers")
+	}
+}
+
+func TestReadLinesJoinsLongLines(t *testing.T) {
+	proc := &Process{log: zap.NewNop(), logs: NewLogHub().NewBuffer()}
+	long := strings.Repeat("a", 10000)
+	huge := strings.Repeat("b", LOG_LINE_MAX+10)
+
+	var readers sync.WaitGroup
+	readers.Add(1)
+	proc.readLines(&readers, STREAM_STDERR, strings.NewReader(long+"\nshort\n"+huge+"\nlast"))
+
+	lines := proc.logs.Lines("")
+	expected := []string{long, "short", huge[:LOG_LINE_MAX], "last"}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v lines, got %v", len(expected), len(lines))
+	}
+	for idx, line := range lines {
+		if line.Message != expected[idx] {
+			t.Fatalf("expected line %v to have %v bytes, got %v", idx, len(expected[idx]), len(line.Message))
+		}
+	}
+
+	if tail := proc.StderrTail(); len(tail) != len(expected) || tail[0] != long {
+		t.Fatalf("expected the stderr tail to hold whole lines, got %v lines", len(tail))
+	}
+}
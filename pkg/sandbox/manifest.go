@@ -0,0 +1,175 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	MANIFEST_FILE = "fusion.json"
+)
+
+// Manifest is the optional project file describing how a version should be run.
+// Fields that are left empty fall back to the sandbox's default Command.
+type Manifest struct {
+	Exec       string            `json:"exec"`
+	Args       []string          `json:"args"`
+	Env        map[string]string `json:"env"`
+	HealthPath string            `json:"healthPath"`
+	PortEnv    string            `json:"portEnv"`
+
+	// StopSignal is a signal name such as "SIGINT" or "TERM", StopTimeout a Go duration such as "30s".
+	StopSignal  string `json:"stopSignal"`
+	StopTimeout string `json:"stopTimeout"`
+
+	// Restart is one of "always", "on-failure" or "never".
+	Restart string `json:"restart"`
+
+	// StartTimeout is how long a new version has to become healthy, as a Go duration.
+	StartTimeout string `json:"startTimeout"`
+
+	// RestartPatterns enables hot reloading, versions that only change files matching none of these globs
+	// are updated in place without restarting the process. Patterns without a "/" match the file's base
+	// name anywhere, "**" matches any number of directories. Changes to the manifest always restart.
+	RestartPatterns []string `json:"restartPatterns"`
+
+	// ReloadSignal is sent to the process and ReloadPath is POSTed to after a hot reload.
+	ReloadSignal string `json:"reloadSignal"`
+	ReloadPath   string `json:"reloadPath"`
+}
+
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	signal, ok := signals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %v", name)
+	}
+	return signal, nil
+}
+
+func ReadManifest(workDir string) (*Manifest, error) {
+	path := filepath.Join(workDir, MANIFEST_FILE)
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %v: %w", path, err)
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %v: %w", path, err)
+	}
+
+	return &manifest, nil
+}
+
+// LoadCommand builds the Command for the version rebuilt into workDir, applying its manifest over the defaults.
+func LoadCommand(workDir string, defaults Command) (Command, error) {
+	command := defaults
+	command.WorkDir = workDir
+
+	manifest, err := ReadManifest(workDir)
+	if err != nil {
+		return command, err
+	}
+	if manifest == nil {
+		return command, nil
+	}
+
+	if manifest.Exec != "" {
+		command.Exec = manifest.Exec
+		command.Args = manifest.Args
+	} else if manifest.Args != nil {
+		command.Args = manifest.Args
+	}
+
+	if len(manifest.Env) > 0 {
+		env := make(map[string]string, len(defaults.Env)+len(manifest.Env))
+		for key, value := range defaults.Env {
+			env[key] = value
+		}
+		for key, value := range manifest.Env {
+			env[key] = value
+		}
+		command.Env = env
+	}
+
+	if manifest.HealthPath != "" {
+		command.HealthPath = manifest.HealthPath
+	}
+
+	if manifest.PortEnv != "" {
+		command.PortEnv = manifest.PortEnv
+	}
+
+	if manifest.StopSignal != "" {
+		command.StopSignal, err = parseSignal(manifest.StopSignal)
+		if err != nil {
+			return command, err
+		}
+	}
+
+	if manifest.StopTimeout != "" {
+		command.StopTimeout, err = time.ParseDuration(manifest.StopTimeout)
+		if err != nil {
+			return command, fmt.Errorf("failed to parse stop timeout %v: %w", manifest.StopTimeout, err)
+		}
+	}
+
+	if manifest.StartTimeout != "" {
+		command.StartTimeout, err = time.ParseDuration(manifest.StartTimeout)
+		if err != nil {
+			return command, fmt.Errorf("failed to parse start timeout %v: %w", manifest.StartTimeout, err)
+		}
+	}
+
+	if manifest.Restart != "" {
+		command.Restart, err = ParseRestartPolicy(manifest.Restart)
+		if err != nil {
+			return command, err
+		}
+	}
+
+	for _, pattern := range manifest.RestartPatterns {
+		err = validateGlob(pattern)
+		if err != nil {
+			return command, err
+		}
+	}
+	command.RestartPatterns = manifest.RestartPatterns
+
+	if manifest.ReloadSignal != "" {
+		command.ReloadSignal, err = parseSignal(manifest.ReloadSignal)
+		if err != nil {
+			return command, err
+		}
+	}
+
+	command.ReloadPath = manifest.ReloadPath
+
+	return command, nil
+}
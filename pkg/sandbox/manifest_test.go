@@ -0,0 +1,110 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLoadCommand(t *testing.T) {
+	defaults := NewCommand("node", []string{"script.mjs"}, "")
+	defaults.Env = map[string]string{"A": "1", "B": "2"}
+
+	cases := []struct {
+		name     string
+		manifest string
+		expected func(command *Command)
+		err      bool
+	}{
+		{
+			name:     "no manifest",
+			expected: func(command *Command) {},
+		},
+		{
+			name:     "exec replaces args",
+			manifest: `{"exec": "bun"}`,
+			expected: func(command *Command) {
+				command.Exec = "bun"
+				command.Args = nil
+			},
+		},
+		{
+			name:     "args only",
+			manifest: `{"args": ["server.mjs"]}`,
+			expected: func(command *Command) {
+				command.Args = []string{"server.mjs"}
+			},
+		},
+		{
+			name:     "env merged over defaults",
+			manifest: `{"env": {"B": "3", "C": "4"}}`,
+			expected: func(command *Command) {
+				command.Env = map[string]string{"A": "1", "B": "3", "C": "4"}
+			},
+		},
+		{
+			name: "process settings",
+			manifest: `{
+				"healthPath": "/up",
+				"portEnv": "HTTP_PORT",
+				"stopSignal": "int",
+				"stopTimeout": "5s",
+				"startTimeout": "1m",
+				"restart": "never",
+				"restartPatterns": ["*.mjs", "src/**"],
+				"reloadSignal": "SIGHUP",
+				"reloadPath": "/reload"
+			}`,
+			expected: func(command *Command) {
+				command.HealthPath = "/up"
+				command.PortEnv = "HTTP_PORT"
+				command.StopSignal = syscall.SIGINT
+				command.StopTimeout = 5 * time.Second
+				command.StartTimeout = time.Minute
+				command.Restart = RESTART_NEVER
+				command.RestartPatterns = []string{"*.mjs", "src/**"}
+				command.ReloadSignal = syscall.SIGHUP
+				command.ReloadPath = "/reload"
+			},
+		},
+		{name: "invalid json", manifest: `{`, err: true},
+		{name: "invalid signal", manifest: `{"stopSignal": "SIGKILL"}`, err: true},
+		{name: "invalid stop timeout", manifest: `{"stopTimeout": "soon"}`, err: true},
+		{name: "invalid restart policy", manifest: `{"restart": "sometimes"}`, err: true},
+		{name: "invalid restart pattern", manifest: `{"restartPatterns": ["src/["]}`, err: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			workDir := t.TempDir()
+			if tc.manifest != "" {
+				err := os.WriteFile(filepath.Join(workDir, MANIFEST_FILE), []byte(tc.manifest), 0644)
+				if err != nil {
+					t.Fatalf("failed to write manifest: %v", err)
+				}
+			}
+
+			command, err := LoadCommand(workDir, defaults)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", command)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load command: %v", err)
+			}
+
+			expected := defaults
+			expected.WorkDir = workDir
+			tc.expected(&expected)
+
+			if !reflect.DeepEqual(command, expected) {
+				t.Fatalf("expected %+v, got %+v", expected, command)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/o1egl/paseto"
+	"go.uber.org/zap"
+)
+
+const (
+	META_PREFIX = "/__meta__/v1/"
+
+	META_AUDIENCE  = "fusion.sandbox"
+	META_ISSUER    = "fusion.manager"
+	META_TOKEN_TTL = time.Minute
+
+	// META_TOKEN_SKEW tolerates sandbox clocks that are slightly behind the manager's.
+	META_TOKEN_SKEW = 5 * time.Second
+
+	// Tokens are bound to a single request, so a leaked status token can't be replayed to redeploy and a
+	// leaked version token can't be replayed with another version.
+	META_CLAIM_METHOD = "method"
+	META_CLAIM_PATH   = "path"
+	META_CLAIM_QUERY  = "query"
+	META_CLAIM_BODY   = "body"
+
+	META_BODY_MAX = 1 << 20
+)
+
+type MetaError struct {
+	Error   string        `json:"error"`
+	Failure *StartFailure `json:"failure,omitempty"`
+}
+
+type VersionRequest struct {
+	Version *int64 `json:"version"`
+}
+
+type VersionResponse struct {
+	Version int64 `json:"version"`
+}
+
+type SplitRequest struct {
+	Weights map[int64]int `json:"weights"`
+}
+
+type metaStatusError struct {
+	status int
+	err    error
+}
+
+func (e *metaStatusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *metaStatusError) Unwrap() error {
+	return e.err
+}
+
+func metaBadRequest(err error) error {
+	return &metaStatusError{status: http.StatusBadRequest, err: err}
+}
+
+// SignMetaToken mints a short lived token authorizing the bearer to call method on the meta API path of
+// project's sandbox.
+// SignMetaToken issues a token for a single meta request, identified by its method, path, raw query and body.
+func SignMetaToken(privateKey ed25519.PrivateKey, project int64, method, path, query string, body []byte) (string, error) {
+	now := time.Now()
+
+	token := paseto.JSONToken{
+		Audience:   META_AUDIENCE,
+		Issuer:     META_ISSUER,
+		Subject:    strconv.FormatInt(project, 10),
+		IssuedAt:   now,
+		NotBefore:  now,
+		Expiration: now.Add(META_TOKEN_TTL),
+	}
+	token.Set(META_CLAIM_METHOD, method)
+	token.Set(META_CLAIM_PATH, path)
+	token.Set(META_CLAIM_QUERY, query)
+	token.Set(META_CLAIM_BODY, bodyHash(body))
+
+	return paseto.NewV2().Sign(privateKey, token, nil)
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func verifyMetaToken(publicKey ed25519.PublicKey, project int64, req *http.Request) error {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return errors.New("missing meta token")
+	}
+
+	var token paseto.JSONToken
+	err := paseto.NewV2().Verify(strings.TrimPrefix(header, "Bearer "), publicKey, &token, nil)
+	if err != nil {
+		return fmt.Errorf("invalid meta token: %w", err)
+	}
+
+	if token.Expiration.IsZero() {
+		return errors.New("meta token has no expiration")
+	}
+
+	err = token.Validate(
+		paseto.ForAudience(META_AUDIENCE),
+		paseto.IssuedBy(META_ISSUER),
+		paseto.Subject(strconv.FormatInt(project, 10)),
+		paseto.ValidAt(time.Now().Add(META_TOKEN_SKEW)),
+	)
+	if err != nil {
+		return fmt.Errorf("invalid meta token: %w", err)
+	}
+
+	if token.Get(META_CLAIM_METHOD) != req.Method || token.Get(META_CLAIM_PATH) != req.URL.Path || token.Get(META_CLAIM_QUERY) != req.URL.RawQuery {
+		return fmt.Errorf("meta token was not issued for %v %v", req.Method, req.URL.RequestURI())
+	}
+
+	// The body is buffered to be hashed, handlers read it back from memory.
+	body, err := io.ReadAll(io.LimitReader(req.Body, META_BODY_MAX+1))
+	if err != nil {
+		return fmt.Errorf("failed to read meta request body: %w", err)
+	}
+	if len(body) > META_BODY_MAX {
+		return fmt.Errorf("meta request body is larger than %v bytes", META_BODY_MAX)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	if token.Get(META_CLAIM_BODY) != bodyHash(body) {
+		return errors.New("meta token was not issued for this request body")
+	}
+
+	return nil
+}
+
+// startMetaApi registers the versioned control API, every route requires a token signed by the manager
+// for the controller's project and replies with JSON, including errors.
+func startMetaApi(ctx context.Context, log *zap.Logger, mux *http.ServeMux, controller *Controller, publicKey ed25519.PublicKey) {
+	route := func(method, name string, handler http.HandlerFunc) {
+		path := META_PREFIX + name
+
+		mux.HandleFunc(path, func(resp http.ResponseWriter, req *http.Request) {
+			log.Info("incoming meta request", zap.String("method", req.Method), zap.String("url", req.URL.String()))
+
+			err := verifyMetaToken(publicKey, controller.project, req)
+			if err != nil {
+				log.Warn("rejected meta request", zap.String("remote", req.RemoteAddr), zap.Error(err))
+				writeMetaErr(log, resp, http.StatusUnauthorized, err)
+				return
+			}
+
+			if req.Method != method {
+				resp.Header().Set("Allow", method)
+				writeMetaErr(log, resp, http.StatusMethodNotAllowed, fmt.Errorf("%v only supports %v", path, method))
+				return
+			}
+
+			handler(resp, req)
+		})
+	}
+
+	route(http.MethodGet, "status", jsonHandler(log, func(req *http.Request) (any, error) {
+		return controller.Status(), nil
+	}))
+
+	route(http.MethodGet, "stats", jsonHandler(log, func(req *http.Request) (any, error) {
+		return controller.Stats(), nil
+	}))
+
+	route(http.MethodGet, "logs", func(resp http.ResponseWriter, req *http.Request) {
+		serveLogs(log, controller, resp, req)
+	})
+
+	route(http.MethodGet, "events", func(resp http.ResponseWriter, req *http.Request) {
+		serveEvents(log, controller, resp, req)
+	})
+
+	// Deploys aren't cancelled when the caller disconnects, so that a timed out manager request doesn't
+	// leave the next process half booted.
+	route(http.MethodPost, "version", jsonHandler(log, func(req *http.Request) (any, error) {
+		var versionReq VersionRequest
+
+		err := json.NewDecoder(req.Body).Decode(&versionReq)
+		if err != nil {
+			return nil, metaBadRequest(fmt.Errorf("failed to decode version request: %w", err))
+		}
+
+		version, err := controller.StartProcess(ctx, versionReq.Version)
+		if err != nil {
+			return nil, err
+		}
+		return VersionResponse{Version: version}, nil
+	}))
+
+	route(http.MethodPost, "restart", jsonHandler(log, func(req *http.Request) (any, error) {
+		version, err := controller.Restart(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return VersionResponse{Version: version}, nil
+	}))
+
+	route(http.MethodPost, "warm", jsonHandler(log, func(req *http.Request) (any, error) {
+		version, err := decodeVersion(req)
+		if err != nil {
+			return nil, err
+		}
+
+		err = controller.Warm(ctx, version)
+		if err != nil {
+			return nil, err
+		}
+		return controller.Status(), nil
+	}))
+
+	route(http.MethodPost, "unwarm", jsonHandler(log, func(req *http.Request) (any, error) {
+		version, err := decodeVersion(req)
+		if err != nil {
+			return nil, err
+		}
+
+		err = controller.Unwarm(version)
+		if err != nil {
+			return nil, err
+		}
+		return controller.Status(), nil
+	}))
+
+	route(http.MethodPost, "split", jsonHandler(log, func(req *http.Request) (any, error) {
+		var splitReq SplitRequest
+
+		err := json.NewDecoder(req.Body).Decode(&splitReq)
+		if err != nil {
+			return nil, metaBadRequest(fmt.Errorf("failed to decode split request: %w", err))
+		}
+
+		err = controller.SetSplit(splitReq.Weights)
+		if err != nil {
+			return nil, err
+		}
+		return controller.Status(), nil
+	}))
+
+	route(http.MethodPost, "drain", jsonHandler(log, func(req *http.Request) (any, error) {
+		err := controller.Drain(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		return controller.Status(), nil
+	}))
+}
+
+// decodeVersion reads a version request that must name a version.
+func decodeVersion(req *http.Request) (int64, error) {
+	var versionReq VersionRequest
+
+	err := json.NewDecoder(req.Body).Decode(&versionReq)
+	if err != nil {
+		return -1, metaBadRequest(fmt.Errorf("failed to decode version request: %w", err))
+	}
+	if versionReq.Version == nil {
+		return -1, metaBadRequest(errors.New("missing version"))
+	}
+
+	return *versionReq.Version, nil
+}
+
+func jsonHandler(log *zap.Logger, handler func(req *http.Request) (any, error)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		body, err := handler(req)
+		if err != nil {
+			writeMetaErr(log, resp, metaStatus(err), err)
+			return
+		}
+		writeJSON(log, resp, http.StatusOK, body)
+	}
+}
+
+func metaStatus(err error) int {
+	var statusErr *metaStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.status
+	case IsStartFailure(err):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidSplit):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNoCurrentProcess), errors.Is(err, ErrVersionUnavailable), errors.Is(err, ErrTooManyWarm):
+		return http.StatusConflict
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeMetaErr(log *zap.Logger, resp http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		log.Error("meta request failed", zap.Int("status", status), zap.Error(err))
+	}
+
+	body := MetaError{Error: err.Error()}
+	errors.As(err, &body.Failure)
+
+	writeJSON(log, resp, status, body)
+}
+
+func writeJSON(log *zap.Logger, resp http.ResponseWriter, status int, body any) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+
+	err := json.NewEncoder(resp).Encode(body)
+	if err != nil {
+		log.Error("failed to write meta response", zap.Error(err))
+	}
+}
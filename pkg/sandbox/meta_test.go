@@ -0,0 +1,59 @@
+package sandbox
+
+import (
+	"crypto/ed25519"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyMetaTokenBindsRequest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	body := `{"version": 2}`
+	token, err := SignMetaToken(privateKey, 1, http.MethodPost, META_PREFIX+"version", "", []byte(body))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		project int64
+		method  string
+		target  string
+		body    string
+		valid   bool
+	}{
+		{name: "issued request", project: 1, method: http.MethodPost, target: META_PREFIX + "version", body: body, valid: true},
+		{name: "other project", project: 2, method: http.MethodPost, target: META_PREFIX + "version", body: body},
+		{name: "other method", project: 1, method: http.MethodGet, target: META_PREFIX + "version", body: body},
+		{name: "other path", project: 1, method: http.MethodPost, target: META_PREFIX + "restart", body: body},
+		{name: "other query", project: 1, method: http.MethodPost, target: META_PREFIX + "version?force=true", body: body},
+		{name: "other body", project: 1, method: http.MethodPost, target: META_PREFIX + "version", body: `{"version": 3}`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			err := verifyMetaToken(publicKey, tc.project, req)
+			if tc.valid != (err == nil) {
+				t.Fatalf("expected valid to be %v, got %v", tc.valid, err)
+			}
+			if err != nil {
+				return
+			}
+
+			read, err := io.ReadAll(req.Body)
+			if err != nil || string(read) != tc.body {
+				t.Fatalf("expected the body to be readable after verification, got %q: %v", read, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	SOCKET_PROBE_TIMEOUT = 100 * time.Millisecond
+)
+
+// PortAllocator hands out ports that aren't held by another process of this sandbox and that nothing else
+// is listening on. When a socket directory is configured each port is instead mapped to a Unix domain
+// socket path and only serves as the process's identifier.
+type PortAllocator struct {
+	host      string
+	start     int
+	size      int
+	offset    int
+	socketDir string
+	held      map[int]bool
+}
+
+func NewPortAllocator(host string, start, size int, socketDir string) *PortAllocator {
+	return &PortAllocator{
+		host:      host,
+		start:     start,
+		size:      size,
+		socketDir: socketDir,
+		held:      make(map[int]bool),
+	}
+}
+
+// Allocate is not safe for concurrent use, the Controller calls it while holding procMutex.
+func (a *PortAllocator) Allocate() (int, error) {
+	for attempt := 0; attempt < a.size; attempt++ {
+		a.offset = (a.offset + 1) % a.size
+		port := a.start + a.offset
+
+		if a.held[port] {
+			continue
+		}
+
+		if !a.isFree(port) {
+			continue
+		}
+
+		if a.socketDir != "" {
+			err := os.MkdirAll(filepath.Dir(a.Socket(port)), 0755)
+			if err != nil {
+				return -1, fmt.Errorf("failed to create socket dir for port %v: %w", port, err)
+			}
+		}
+
+		a.held[port] = true
+		return port, nil
+	}
+
+	return -1, fmt.Errorf("no free port in range %v-%v", a.start, a.start+a.size-1)
+}
+
+// Release returns a port once its process has exited.
+func (a *PortAllocator) Release(port int) {
+	delete(a.held, port)
+
+	if a.socketDir != "" {
+		os.RemoveAll(filepath.Dir(a.Socket(port)))
+	}
+}
+
+// Socket returns the Unix domain socket path for a port, or "" when processes listen on TCP. Each socket
+// has its own directory so that isolated processes can only write their own.
+func (a *PortAllocator) Socket(port int) string {
+	if a.socketDir == "" {
+		return ""
+	}
+	return filepath.Join(a.socketDir, fmt.Sprintf("proc-%d", port), "proc.sock")
+}
+
+func (a *PortAllocator) isFree(port int) bool {
+	if a.socketDir != "" {
+		return a.isSocketFree(a.Socket(port))
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(a.host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// isSocketFree removes stale socket files left behind by processes that didn't clean up.
+func (a *PortAllocator) isSocketFree(path string) bool {
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+
+	conn, err := net.DialTimeout("unix", path, SOCKET_PROBE_TIMEOUT)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+
+	return os.Remove(path) == nil
+}
+
+// DialContext connects to a process by the "host:port" address the proxy uses, switching to the port's
+// Unix domain socket when one is configured.
+func (a *PortAllocator) DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if a.socketDir == "" {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		_, portString, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %v: %w", addr, err)
+		}
+
+		return dialer.DialContext(ctx, "unix", a.Socket(port))
+	}
+}
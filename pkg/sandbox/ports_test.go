@@ -0,0 +1,118 @@
+package sandbox
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllocateSkipsBusyAndHeldPorts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	a := NewPortAllocator("127.0.0.1", port, 1, "")
+
+	_, err = a.Allocate()
+	if err == nil {
+		t.Fatalf("expected port %v to be busy", port)
+	}
+
+	listener.Close()
+
+	allocated, err := a.Allocate()
+	if err != nil {
+		t.Fatalf("failed to allocate: %v", err)
+	}
+	if allocated != port {
+		t.Fatalf("expected port %v, got %v", port, allocated)
+	}
+
+	_, err = a.Allocate()
+	if err == nil {
+		t.Fatalf("expected port %v to be held", port)
+	}
+
+	a.Release(port)
+	allocated, err = a.Allocate()
+	if err != nil {
+		t.Fatalf("failed to allocate released port: %v", err)
+	}
+	if allocated != port {
+		t.Fatalf("expected port %v, got %v", port, allocated)
+	}
+}
+
+func TestAllocateSockets(t *testing.T) {
+	a := NewPortAllocator("", 8000, 2, t.TempDir())
+
+	first, err := a.Allocate()
+	if err != nil {
+		t.Fatalf("failed to allocate: %v", err)
+	}
+	second, err := a.Allocate()
+	if err != nil {
+		t.Fatalf("failed to allocate: %v", err)
+	}
+	if first == second {
+		t.Fatalf("expected distinct ports, got %v twice", first)
+	}
+
+	if filepath.Dir(a.Socket(first)) == filepath.Dir(a.Socket(second)) {
+		t.Fatalf("expected each socket in its own dir, got %v and %v", a.Socket(first), a.Socket(second))
+	}
+	_, err = os.Stat(filepath.Dir(a.Socket(first)))
+	if err != nil {
+		t.Fatalf("expected socket dir to exist: %v", err)
+	}
+
+	_, err = a.Allocate()
+	if err == nil {
+		t.Fatalf("expected every port to be held")
+	}
+
+	a.Release(first)
+	_, err = os.Stat(filepath.Dir(a.Socket(first)))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected socket dir to be removed, got %v", err)
+	}
+}
+
+func TestAllocateSocketsReplacesStaleSockets(t *testing.T) {
+	a := NewPortAllocator("", 8000, 1, t.TempDir())
+	socket := a.Socket(8000)
+
+	err := os.MkdirAll(filepath.Dir(socket), 0755)
+	if err != nil {
+		t.Fatalf("failed to create socket dir: %v", err)
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on %v: %v", socket, err)
+	}
+
+	_, err = a.Allocate()
+	if err == nil {
+		t.Fatalf("expected socket %v to be busy", socket)
+	}
+
+	// Closing a listener removes its socket, a crashed process leaves it behind.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	port, err := a.Allocate()
+	if err != nil {
+		t.Fatalf("failed to allocate over stale socket: %v", err)
+	}
+	if port != 8000 {
+		t.Fatalf("expected port 8000, got %v", port)
+	}
+	_, err = os.Stat(socket)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected stale socket to be removed, got %v", err)
+	}
+}
@@ -8,118 +8,431 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+type ExitReason string
+
+const (
+	EXIT_REASON_EXITED  ExitReason = "exited"
+	EXIT_REASON_FAILED  ExitReason = "failed"
+	EXIT_REASON_STOPPED ExitReason = "stopped"
+	EXIT_REASON_KILLED  ExitReason = "killed"
+
+	EXIT_REASON_UNHEALTHY ExitReason = "unhealthy"
+	EXIT_REASON_OOM       ExitReason = "oom"
+)
+
+type ExitStatus struct {
+	Code   int        `json:"code"`
+	Signal string     `json:"signal"`
+	Reason ExitReason `json:"reason"`
+	At     time.Time  `json:"at"`
+}
+
+const (
+	STDERR_TAIL_LINES = 20
+
+	// OUTPUT_DRAIN_TIMEOUT is how long the output of an exited process is read before reporting its exit.
+	OUTPUT_DRAIN_TIMEOUT = time.Second
+
+	// LOG_LINE_MAX bounds the memory held by a process that never writes a newline, longer lines are truncated.
+	LOG_LINE_MAX = 64 * 1024
+)
+
 type Process struct {
-	log        *zap.Logger
-	executable string
-	script     string
-	port       int
-	version    int64
+	log     *zap.Logger
+	command Command
+	port    int
+	socket  string
+
+	// version changes when the process is hot reloaded, it's written holding both the Controller's
+	// procMutex and mutex so that it can be read holding either.
+	version int64
+
+	isolation *Isolation
 
-	pid        *int
-	cancelFunc context.CancelFunc
+	cmd        *exec.Cmd
+	done       chan struct{}
+	logs       *LogBuffer
+	cgroup     *Cgroup
+	startedAt  time.Time
+	promotedAt time.Time
+
+	// state and failure are guarded by the Controller's procMutex.
+	state   ProcessState
+	failure *StartFailure
+
+	mutex      sync.Mutex
+	stopping   bool
+	killed     bool
+	unhealthy  bool
+	exitStatus *ExitStatus
+
+	// stderrTail is kept apart from logs so that a chatty stdout can't push the stderr lines explaining a
+	// failure out of the ring.
+	stderrTail []string
 }
 
-func NewProcess(log *zap.Logger, executable, script string, port int, version int64) *Process {
+// NewProcess creates a process identified by port, which listens on socket instead when it isn't empty.
+func NewProcess(log *zap.Logger, logs *LogHub, command Command, port int, socket string, version int64) *Process {
 	return &Process{
-		log:        log,
-		executable: executable,
-		script:     script,
-		port:       port,
-		version:    version,
+		log:     log,
+		command: command,
+		port:    port,
+		socket:  socket,
+		version: version,
+		done:    make(chan struct{}),
+		logs:    logs.NewBuffer(),
 	}
 }
 
-func (p *Process) Run(parentCtx context.Context) error {
-	ctx, cancel := context.WithCancel(parentCtx)
-	p.cancelFunc = cancel
+func (p *Process) Run(ctx context.Context) error {
+	cmd := exec.Command(p.command.Exec, p.command.Args...)
+	cmd.Dir = p.command.WorkDir
+	env := os.Environ()
+	if p.isolation != nil {
+		env = p.isolation.environ()
+	}
 
-	cmd := exec.CommandContext(ctx, p.executable, p.script)
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("PR_PORT=%d", p.port),
-		fmt.Sprintf("PR_VERSION=%d", p.version),
-	)
+	cmd.Env = append(env, fmt.Sprintf("PR_VERSION=%d", p.version))
+	for key, value := range p.command.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	if p.socket != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PR_SOCKET=%s", p.socket))
+	} else {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PR_PORT=%d", p.port))
+		if p.command.PortEnv != "" {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", p.command.PortEnv, p.port))
+		}
+	}
+
+	// Run in a new process group so that signals reach every child the process spawns.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	stdoutPipe, err := cmd.StdoutPipe()
+	if p.isolation != nil {
+		err := p.isolation.wrap(cmd)
+		if err != nil {
+			return fmt.Errorf("failed to isolate process: %w", err)
+		}
+	}
+
+	if p.cgroup != nil {
+		dir, err := p.cgroup.attach(cmd)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+	}
+
+	// The pipes are created here rather than by cmd so that Wait doesn't close them before every line is read.
+	stdoutRead, stdoutWrite, err := os.Pipe()
 	if err != nil {
 		return fmt.Errorf("failed to pipe stdout: %w", err)
 	}
 
-	stderrPipe, err := cmd.StderrPipe()
+	stderrRead, stderrWrite, err := os.Pipe()
 	if err != nil {
+		stdoutRead.Close()
+		stdoutWrite.Close()
 		return fmt.Errorf("failed to pipe stderr: %w", err)
 	}
 
+	cmd.Stdout = stdoutWrite
+	cmd.Stderr = stderrWrite
+
+	p.log.Info("start proc", zap.Int("port", p.port))
+	err = cmd.Start()
+	stdoutWrite.Close()
+	stderrWrite.Close()
+	if err != nil {
+		stdoutRead.Close()
+		stderrRead.Close()
+		return fmt.Errorf("cannot start process [%v %v]: %w", p.command.Exec, p.command.Args, err)
+	}
+
+	p.cmd = cmd
+	p.startedAt = time.Now()
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go p.readLines(&readers, STREAM_STDOUT, stdoutRead)
+	go p.readLines(&readers, STREAM_STDERR, stderrRead)
+
 	go func() {
-		stdout := make(chan string)
-		go func() {
-			reader := bufio.NewReader(stdoutPipe)
-			for {
-				line, _, err := reader.ReadLine()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					p.log.Error("failed to read stdout line", zap.Error(err))
-					return
-				}
-				stdout <- string(line)
-			}
-		}()
+		waitErr := cmd.Wait()
 
-		stderr := make(chan string)
+		drained := make(chan struct{})
 		go func() {
-			reader := bufio.NewReader(stderrPipe)
-			for {
-				line, _, err := reader.ReadLine()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					p.log.Error("failed to read stderr line", zap.Error(err))
-					return
-				}
-				stdout <- string(line)
-			}
+			readers.Wait()
+			close(drained)
 		}()
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-stdout:
-				p.log.Info("stdout", zap.String("msg", msg), zap.Int("port", p.port))
-			case msg := <-stderr:
-				p.log.Info("stderr", zap.String("msg", msg), zap.Int("port", p.port))
-			}
+		// Children that inherited the output keep the pipes open after the process exits, they're killed
+		// so that the exit is still reported.
+		select {
+		case <-drained:
+		case <-time.After(OUTPUT_DRAIN_TIMEOUT):
+			p.log.Warn("output still open after exit, killing process group", zap.Int("port", p.port))
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			stdoutRead.Close()
+			stderrRead.Close()
+			<-drained
 		}
+
+		stdoutRead.Close()
+		stderrRead.Close()
+		p.reap(waitErr)
 	}()
 
-	p.log.Info("start proc", zap.Int("port", p.port))
-	err = cmd.Start()
-	if err != nil {
-		return fmt.Errorf("cannot start process [%v %v]: %w", p.executable, p.script, err)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Kill()
+		case <-p.done:
+		}
+	}()
+
+	return nil
+}
+
+func (p *Process) readLines(readers *sync.WaitGroup, stream string, pipe io.Reader) {
+	defer readers.Done()
+
+	reader := bufio.NewReader(pipe)
+	for {
+		line, err := readLine(reader)
+		if err == io.EOF || errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			p.log.Error("failed to read process output", zap.String("stream", stream), zap.Int("port", p.port), zap.Error(err))
+			return
+		}
+
+		version := p.Version()
+		p.log.Debug(stream, zap.String("msg", string(line)), zap.Int("port", p.port), zap.Int64("version", version))
+		p.logs.Append(LogLine{
+			At:      time.Now(),
+			Stream:  stream,
+			Port:    p.port,
+			Version: version,
+			Message: string(line),
+		})
+
+		if stream == STREAM_STDERR {
+			p.appendStderr(string(line))
+		}
+	}
+}
+
+// readLine joins the fragments of lines longer than the reader's buffer into a single line.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		fragment, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line == nil && !isPrefix {
+			return fragment, nil
+		}
+		if room := LOG_LINE_MAX - len(line); room > 0 {
+			if len(fragment) > room {
+				fragment = fragment[:room]
+			}
+			line = append(line, fragment...)
+		}
+
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+func (p *Process) appendStderr(line string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.stderrTail = append(p.stderrTail, line)
+	if len(p.stderrTail) > STDERR_TAIL_LINES {
+		p.stderrTail = p.stderrTail[len(p.stderrTail)-STDERR_TAIL_LINES:]
+	}
+}
+
+func (p *Process) reap(waitErr error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	status := &ExitStatus{
+		Code:   -1,
+		Reason: EXIT_REASON_EXITED,
+		At:     time.Now(),
+	}
+
+	if state := p.cmd.ProcessState; state != nil {
+		status.Code = state.ExitCode()
+		if waitStatus, ok := state.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+			status.Signal = waitStatus.Signal().String()
+		}
+	}
+
+	oomKilled := p.cgroup != nil && p.cgroup.OOMKilled()
+
+	switch {
+	case oomKilled:
+		status.Reason = EXIT_REASON_OOM
+	case p.unhealthy:
+		status.Reason = EXIT_REASON_UNHEALTHY
+	case p.killed:
+		status.Reason = EXIT_REASON_KILLED
+	case p.stopping:
+		status.Reason = EXIT_REASON_STOPPED
+	case status.Code != 0:
+		status.Reason = EXIT_REASON_FAILED
+	}
+
+	p.exitStatus = status
+
+	if p.cgroup != nil {
+		err := p.cgroup.Remove()
+		if err != nil {
+			p.log.Warn("failed to remove cgroup", zap.Int("port", p.port), zap.Error(err))
+		}
+	}
+
+	close(p.done)
+
+	p.log.Info("proc exited", zap.Int("port", p.port), zap.Int64("version", p.version),
+		zap.Int("code", status.Code), zap.String("signal", status.Signal), zap.String("reason", string(status.Reason)), zap.NamedError("wait", waitErr))
+}
+
+// StderrTail returns the last STDERR_TAIL_LINES lines written to stderr.
+func (p *Process) StderrTail() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	tail := make([]string, len(p.stderrTail))
+	copy(tail, p.stderrTail)
+	return tail
+}
+
+type ProcessStats struct {
+	Port      int          `json:"port"`
+	Version   int64        `json:"version"`
+	State     ProcessState `json:"state"`
+	Pid       int          `json:"pid"`
+	StartedAt time.Time    `json:"startedAt"`
+	Cgroup    *CgroupStats `json:"cgroup,omitempty"`
+	Exit      *ExitStatus  `json:"exit,omitempty"`
+}
+
+// Stats reads the resource usage of the process's cgroup, if it runs in one.
+func (p *Process) Stats() (*CgroupStats, error) {
+	if p.cgroup == nil {
+		return nil, nil
 	}
+	return p.cgroup.Stats()
+}
+
+// Done is closed once the process has exited and been reaped.
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// ExitStatus returns nil while the process is still running.
+func (p *Process) ExitStatus() *ExitStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.exitStatus
+}
+
+// Version returns the version currently served by the process.
+func (p *Process) Version() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	p.pid = &cmd.Process.Pid
+	return p.version
+}
+
+// setVersionLocked must be called holding the Controller's procMutex.
+func (p *Process) setVersionLocked(version int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.version = version
+}
+
+// Signal sends sig to the process, but not to the rest of its process group.
+func (p *Process) Signal(sig syscall.Signal) error {
+	err := p.cmd.Process.Signal(sig)
+	if err != nil {
+		return fmt.Errorf("failed to send %v to process %v: %w", sig, p.cmd.Process.Pid, err)
+	}
 	return nil
 }
 
+// markUnhealthy records that the process is being killed for failing its health checks.
+func (p *Process) markUnhealthy() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.unhealthy = true
+}
+
+// Kill sends the stop signal to the process group, escalates to SIGKILL if the process hasn't exited within
+// the command's stop timeout and waits for the process to be reaped.
 func (p *Process) Kill() error {
-	if p.pid == nil {
+	if p.cmd == nil {
 		return errors.New("cannot kill process that wasn't started")
 	}
 
-	// FIXME: Add a timeout & SIGTERM
-	err := syscall.Kill(*p.pid, syscall.SIGINT)
-	if err != nil {
-		return err
+	p.mutex.Lock()
+	if p.exitStatus != nil {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.stopping = true
+	p.mutex.Unlock()
+
+	pgid := p.cmd.Process.Pid
+
+	err := syscall.Kill(-pgid, p.command.StopSignal)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to send %v to process group %v: %w", p.command.StopSignal, pgid, err)
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(p.command.StopTimeout):
+	}
+
+	p.log.Warn("proc did not stop in time, sending SIGKILL", zap.Int("port", p.port), zap.Duration("timeout", p.command.StopTimeout))
+
+	p.mutex.Lock()
+	p.killed = true
+	p.mutex.Unlock()
+
+	err = syscall.Kill(-pgid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to send SIGKILL to process group %v: %w", pgid, err)
+	}
+
+	if p.cgroup != nil {
+		err = p.cgroup.Kill()
+		if err != nil {
+			p.log.Warn("failed to kill cgroup", zap.Int("port", p.port), zap.Error(err))
+		}
 	}
 
-	p.cancelFunc()
+	<-p.done
 	return nil
 }
@@ -0,0 +1,35 @@
+package sandbox
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRunReportsExitWhileChildrenHoldOutput(t *testing.T) {
+	command := NewCommand("sh", []string{"-c", "echo started; sleep 30 & exit 3"}, t.TempDir())
+	proc := NewProcess(zap.NewNop(), NewLogHub(), command, 1, "", 1)
+
+	err := proc.Run(context.Background())
+	if err != nil {
+		t.Fatalf("failed to run process: %v", err)
+	}
+
+	select {
+	case <-proc.Done():
+	case <-time.After(OUTPUT_DRAIN_TIMEOUT + 5*time.Second):
+		t.Fatalf("expected the exit to be reported while a child holds the output")
+	}
+
+	status := proc.ExitStatus()
+	if status.Code != 3 {
+		t.Fatalf("expected exit code 3, got %v", status.Code)
+	}
+
+	lines := proc.logs.Lines(STREAM_STDOUT)
+	if len(lines) != 1 || lines[0].Message != "started" {
+		t.Fatalf("expected output written before the exit to be read, got %v", lines)
+	}
+}
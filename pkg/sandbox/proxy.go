@@ -1,9 +1,9 @@
 package sandbox
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,11 +12,22 @@ import (
 	"strings"
 	"time"
 
+	"github.com/angelini/fusion/internal/upgrade"
 	"go.uber.org/zap"
 )
 
 const (
-	PROXY_REQUEST_READ_TIMEOUT = 5 * time.Second
+	PROXY_CONNECT_TIMEOUT = 5 * time.Second
+	PROXY_HEADER_TIMEOUT  = 30 * time.Second
+	PROXY_IDLE_TIMEOUT    = 90 * time.Second
+
+	PROXY_BUFFER_SIZE = 32 * 1024
+
+	PENDING_HEADER = "X-Fusion-Pending"
+	PENDING_COOKIE = "fusion-pending"
+
+	VERSION_HEADER = "X-Fusion-Version"
+	VERSION_COOKIE = "fusion-version"
 )
 
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
@@ -31,86 +42,251 @@ var hopHeaders = map[string]bool{
 	"Upgrade":             true,
 }
 
-type VersionRequest struct {
-	Version *int64
-}
+// StartProxy serves user traffic on serverPort and the meta API on controlPort, which is never exposed by the
+// sandbox's service and only accepts tokens signed by the manager.
+func StartProxy(ctx context.Context, log *zap.Logger, controller *Controller, serverPort, controlPort int, publicKey ed25519.PublicKey) error {
+	transport := controller.Transport(PROXY_CONNECT_TIMEOUT)
+	transport.ResponseHeaderTimeout = PROXY_HEADER_TIMEOUT
+	transport.IdleConnTimeout = PROXY_IDLE_TIMEOUT
+	transport.DisableCompression = true
 
-func StartProxy(ctx context.Context, log *zap.Logger, controller *Controller, serverPort int) error {
-	httpClient := &http.Client{
-		Timeout: PROXY_REQUEST_READ_TIMEOUT,
-	}
+	controlMux := http.NewServeMux()
+	startMetaApi(ctx, log, controlMux, controller, publicKey)
 
-	http.HandleFunc("/__meta__/version", func(resp http.ResponseWriter, req *http.Request) {
-		log.Info("incoming meta version", zap.String("url", req.URL.String()))
+	controlMux.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
+		writeMetaErr(log, resp, http.StatusNotFound, fmt.Errorf("unknown meta endpoint %v", req.URL.Path))
+	})
+
+	mux := http.NewServeMux()
 
-		var versionReq VersionRequest
+	// Keep the meta namespace reserved so that it's never proxied to the project.
+	mux.HandleFunc("/__meta__/", func(resp http.ResponseWriter, req *http.Request) {
+		writeMetaErr(log, resp, http.StatusNotFound, errors.New("the meta API is only served on the control port"))
+	})
+
+	mux.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
+		reqCtx, cancel := context.WithCancel(req.Context())
+		defer cancel()
 
-		err := json.NewDecoder(req.Body).Decode(&versionReq)
+		log.Info("incoming request", zap.String("url", req.URL.String()))
+
+		route, err := requestRoute(req)
 		if err != nil {
-			httpErr(log, resp, err, "failed to read proxy request body")
+			http.Error(resp, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		version, err := controller.StartProcess(ctx, versionReq.Version)
+		lease, err := controller.AcquireLivePort(reqCtx, route)
+
+		if errors.Is(err, ErrVersionUnavailable) {
+			http.Error(resp, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueTimeout) {
+			resp.Header().Set("Retry-After", strconv.Itoa(int(QUEUE_RETRY_AFTER.Seconds())))
+			http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
-			httpErr(log, resp, err, "failed to start process")
+			resp.Header().Set("Retry-After", strconv.Itoa(int(RESTART_BACKOFF_MAX.Seconds())))
+			http.Error(resp, fmt.Sprintf("sandbox process unavailable: %v", err), http.StatusServiceUnavailable)
 			return
 		}
 
-		fmt.Fprintf(resp, "Version: %d", version)
+		upgraded := false
+		defer func() {
+			if upgraded {
+				controller.ReleaseUpgradedPort(lease.Port)
+			} else {
+				controller.ReleasePort(lease.Port)
+			}
+		}()
+
+		// Pin clients to the version the split picked, so they don't flip between versions on every request.
+		if lease.Split || (route.Sticky && *route.Version != lease.Version) {
+			http.SetCookie(resp, &http.Cookie{
+				Name:     VERSION_COOKIE,
+				Value:    strconv.FormatInt(lease.Version, 10),
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		proxyRequest(reqCtx, cancel, log, transport, resp, req, fmt.Sprintf("%s:%d", controller.Host, lease.Port), func() {
+			controller.UpgradePort(lease.Port)
+			upgraded = true
+		})
 	})
 
-	http.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
-		reqCtx, cancel := context.WithCancel(ctx)
-		defer cancel()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- fmt.Errorf("control listener failed: %w", http.ListenAndServe(":"+strconv.Itoa(controlPort), controlMux))
+	}()
+	go func() {
+		errs <- fmt.Errorf("proxy listener failed: %w", http.ListenAndServe(":"+strconv.Itoa(serverPort), mux))
+	}()
 
-		log.Info("incoming request", zap.String("url", req.URL.String()))
+	return <-errs
+}
 
-		portChan := controller.LivePortChannel(reqCtx)
+// proxyRequest streams the request body to the live process and the response body back to the client,
+// flushing as data arrives. The request is cancelled if neither body makes progress within PROXY_IDLE_TIMEOUT.
+// onUpgrade is called before an upgraded connection is spliced.
+func proxyRequest(ctx context.Context, cancel context.CancelFunc, log *zap.Logger, transport http.RoundTripper, resp http.ResponseWriter, req *http.Request, host string, onUpgrade func()) {
+	idle := time.AfterFunc(PROXY_IDLE_TIMEOUT, cancel)
+	defer idle.Stop()
 
-		select {
-		case <-time.After(PROXY_REQUEST_READ_TIMEOUT):
-			http.Error(resp, "timeout waiting for live port", http.StatusGatewayTimeout)
+	var body io.Reader = http.NoBody
+	if req.ContentLength != 0 {
+		body = &idleReader{reader: req.Body, timer: idle}
+	}
 
-		case port := <-portChan:
-			body, err := io.ReadAll(req.Body)
-			if err != nil {
-				httpErr(log, resp, err, "failed to read proxy request body")
-				return
-			}
+	url := fmt.Sprintf("http://%s%s", host, req.URL.RequestURI())
+	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, url, body)
+	if err != nil {
+		httpErr(log, resp, err, "failed to create proxy request")
+		return
+	}
 
-			url := fmt.Sprintf("http://%s:%d%s", controller.Host, port, req.URL.String())
-			proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
-			if err != nil {
-				httpErr(log, resp, err, "failed to create proxy request")
-				return
-			}
+	proxyReq.ContentLength = req.ContentLength
+	proxyReq.Header = make(http.Header)
+	copyHeader(proxyReq.Header, req.Header, true)
 
-			proxyReq.Header = make(http.Header)
-			copyHeader(proxyReq.Header, req.Header, true)
+	protocol := upgrade.Type(req.Header)
+	if protocol != "" {
+		proxyReq.Header.Set("Connection", "Upgrade")
+		proxyReq.Header.Set("Upgrade", protocol)
+	}
 
-			remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
-			if err == nil {
-				appendHostToXForwardHeader(req.Header, remoteHost)
-			}
+	// Trailers are only populated once the body has been fully read, share the map so they're forwarded.
+	proxyReq.Trailer = req.Trailer
+
+	remoteHost, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err == nil {
+		appendHostToXForwardHeader(proxyReq.Header, remoteHost)
+	}
+
+	proxyResp, err := transport.RoundTrip(proxyReq)
+	if err != nil {
+		httpErr(log, resp, err, "failed to proxy request")
+		return
+	}
+	defer proxyResp.Body.Close()
+
+	if protocol != "" && proxyResp.StatusCode == http.StatusSwitchingProtocols {
+		idle.Stop()
+		onUpgrade()
+
+		err = upgrade.Splice(resp, proxyResp)
+		if err != nil {
+			log.Warn("upgraded connection closed", zap.String("url", url), zap.String("upgrade", protocol), zap.Error(err))
+		}
+		return
+	}
+
+	idle.Reset(PROXY_IDLE_TIMEOUT)
+
+	copyHeader(resp.Header(), proxyResp.Header, true)
+	for key := range proxyResp.Trailer {
+		resp.Header().Add("Trailer", key)
+	}
+
+	resp.WriteHeader(proxyResp.StatusCode)
 
-			controller.IncrementRequestCounter(port)
-			defer controller.DecrementRequestCounter(port)
+	err = copyFlush(resp, &idleReader{reader: proxyResp.Body, timer: idle})
+	if err != nil {
+		log.Warn("failed to stream proxy response", zap.String("url", url), zap.Error(err))
+		return
+	}
 
-			proxyResp, err := httpClient.Do(proxyReq)
+	for key, values := range proxyResp.Trailer {
+		for _, value := range values {
+			resp.Header().Add(key, value)
+		}
+	}
+}
+
+// idleReader resets the idle timer each time data is read.
+type idleReader struct {
+	reader io.Reader
+	timer  *time.Timer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(PROXY_IDLE_TIMEOUT)
+	}
+	return n, err
+}
+
+func copyFlush(dest http.ResponseWriter, src io.Reader) error {
+	flusher, canFlush := dest.(http.Flusher)
+	buffer := make([]byte, PROXY_BUFFER_SIZE)
+
+	for {
+		n, readErr := src.Read(buffer)
+		if n > 0 {
+			_, err := dest.Write(buffer[:n])
 			if err != nil {
-				httpErr(log, resp, err, "failed to proxy request")
-				return
+				return err
+			}
+			if canFlush {
+				flusher.Flush()
 			}
-			defer proxyResp.Body.Close()
+		}
 
-			copyHeader(resp.Header(), proxyResp.Header, false)
-			resp.WriteHeader(proxyResp.StatusCode)
-			io.Copy(resp, proxyResp.Body)
+		if readErr == io.EOF {
+			return nil
 		}
-	})
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
 
-	return http.ListenAndServe(":"+strconv.Itoa(serverPort), nil)
+// isPending reports whether the request asked to be routed to the version that is still booting.
+func isPending(req *http.Request) bool {
+	if value := req.Header.Get(PENDING_HEADER); value != "" {
+		pending, err := strconv.ParseBool(value)
+		return err == nil && pending
+	}
+
+	cookie, err := req.Cookie(PENDING_COOKIE)
+	if err != nil {
+		return false
+	}
+
+	pending, err := strconv.ParseBool(cookie.Value)
+	return err == nil && pending
+}
+
+// requestRoute pins the request to the version in its header, or to the version in its cookie as long as that
+// version is still running.
+func requestRoute(req *http.Request) (Route, error) {
+	route := Route{Pending: isPending(req)}
+
+	if value := req.Header.Get(VERSION_HEADER); value != "" {
+		version, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return route, fmt.Errorf("invalid %v header %q", VERSION_HEADER, value)
+		}
+		route.Version = &version
+		return route, nil
+	}
+
+	cookie, err := req.Cookie(VERSION_COOKIE)
+	if err != nil {
+		return route, nil
+	}
+
+	version, err := strconv.ParseInt(cookie.Value, 10, 64)
+	if err == nil {
+		route.Version = &version
+		route.Sticky = true
+	}
+	return route, nil
 }
 
 func copyHeader(dest, src http.Header, skipHopHeaders bool) {
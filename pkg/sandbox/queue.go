@@ -0,0 +1,195 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_QUEUE_DEPTH = 256
+	DEFAULT_MAX_QUEUE_WAIT  = 5 * time.Second
+
+	QUEUE_RETRY_AFTER = time.Second
+)
+
+var (
+	ErrQueueFull    = errors.New("request queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting for a live process")
+)
+
+// waiter is a request queued until a process can serve its route.
+type waiter struct {
+	route Route
+	lease Lease
+	err   error
+	done  chan struct{}
+}
+
+// AcquireLivePort counts a request against the port of the process serving route, callers must call
+// ReleasePort once the request completes. Pending requests are routed to the next process while it boots,
+// for smoke testing a version before it's promoted.
+//
+// Requests that can't be served straight away, because no process is live or the process is at its
+// concurrency limit, wait in a FIFO queue. They fail with ErrQueueFull when MaxQueueDepth requests are
+// already waiting and with ErrQueueTimeout after MaxQueueWait.
+func (c *Controller) AcquireLivePort(ctx context.Context, route Route) (Lease, error) {
+	c.procMutex.Lock()
+
+	// Serve the queue first so that a request never overtakes one waiting for the same process.
+	c.dispatchLocked()
+	lease, ok, err := c.tryAcquireLocked(route)
+	if ok || err != nil {
+		c.procMutex.Unlock()
+		return lease, err
+	}
+
+	if c.options.MaxQueueDepth > 0 && len(c.queue) >= c.options.MaxQueueDepth {
+		c.procMutex.Unlock()
+		return Lease{}, ErrQueueFull
+	}
+
+	w := &waiter{route: route, done: make(chan struct{})}
+	c.queue = append(c.queue, w)
+	c.procMutex.Unlock()
+
+	var timeout <-chan time.Time
+	if c.options.MaxQueueWait > 0 {
+		timer := time.NewTimer(c.options.MaxQueueWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.done:
+		return w.lease, w.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrQueueTimeout
+	}
+
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	// The request may have been served while the context expired, the caller releases the lease as usual.
+	select {
+	case <-w.done:
+		return w.lease, w.err
+	default:
+	}
+
+	for idx, queued := range c.queue {
+		if queued == w {
+			c.queue = append(c.queue[:idx], c.queue[idx+1:]...)
+			break
+		}
+	}
+	return Lease{}, err
+}
+
+// tryAcquireLocked leases the process serving route if it has capacity, it returns false without an error
+// when the request has to wait.
+func (c *Controller) tryAcquireLocked(route Route) (Lease, bool, error) {
+	proc, split, err := c.routeLocked(route)
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	if proc == nil {
+		if c.crashErr != nil {
+			return Lease{}, false, c.crashErr
+		}
+		return Lease{}, false, nil
+	}
+
+	if c.options.MaxConcurrency > 0 && c.counters[proc.port]-c.upgrades[proc.port] >= c.options.MaxConcurrency {
+		return Lease{}, false, nil
+	}
+
+	c.counters[proc.port] += 1
+	c.lastRequest = time.Now()
+	return Lease{Port: proc.port, Version: proc.version, Split: split}, true, nil
+}
+
+// dispatchLocked serves queued requests in order. Requests that still have to wait keep their place, so
+// requests routed to the same process are served first come, first served.
+func (c *Controller) dispatchLocked() {
+	remaining := c.queue[:0]
+	for _, w := range c.queue {
+		lease, ok, err := c.tryAcquireLocked(w.route)
+		if !ok && err == nil {
+			remaining = append(remaining, w)
+			continue
+		}
+
+		w.lease = lease
+		w.err = err
+		close(w.done)
+	}
+
+	for idx := len(remaining); idx < len(c.queue); idx++ {
+		c.queue[idx] = nil
+	}
+	c.queue = remaining
+}
+
+// UpgradePort stops counting an upgraded connection against the concurrency limit of port, so long lived
+// WebSockets don't starve requests. It's still in flight for draining, callers release it with
+// ReleaseUpgradedPort once it closes.
+func (c *Controller) UpgradePort(port int) {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	c.upgrades[port] += 1
+	c.dispatchLocked()
+}
+
+func (c *Controller) ReleaseUpgradedPort(port int) {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	c.upgrades[port] -= 1
+	if c.upgrades[port] == 0 {
+		delete(c.upgrades, port)
+	}
+
+	c.releaseLocked(port)
+}
+
+func (c *Controller) ReleasePort(port int) {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	c.releaseLocked(port)
+}
+
+func (c *Controller) releaseLocked(port int) {
+	c.counters[port] -= 1
+	c.lastRequest = time.Now()
+
+	if c.counters[port] == 0 {
+		delete(c.counters, port)
+		c.broadcastLocked()
+		return
+	}
+
+	c.dispatchLocked()
+}
+
+func (c *Controller) inFlightLocked() int {
+	inFlight := 0
+	for _, count := range c.counters {
+		inFlight += count
+	}
+	return inFlight
+}
+
+// idleLocked returns how long the sandbox has gone without serving or queueing a request, zero while
+// requests are in flight or queued.
+func (c *Controller) idleLocked() time.Duration {
+	if c.inFlightLocked()+len(c.queue) > 0 {
+		return 0
+	}
+	return time.Since(c.lastRequest)
+}
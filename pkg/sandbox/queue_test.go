@@ -0,0 +1,227 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newQueueController(options Options, current *Process) *Controller {
+	return &Controller{
+		log:      zap.NewNop(),
+		options:  options,
+		changed:  make(chan struct{}),
+		counters: make(map[int]int),
+		upgrades: make(map[int]int),
+		warm:     make(map[int64]*Process),
+		split:    make(map[int64]int),
+		random:   rand.New(rand.NewSource(1)),
+		current:  current,
+	}
+}
+
+func currentProcess(port int, version int64) *Process {
+	return &Process{port: port, version: version, state: STATE_CURRENT}
+}
+
+func waitQueued(t *testing.T, c *Controller, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.procMutex.RLock()
+		queued := len(c.queue)
+		c.procMutex.RUnlock()
+
+		if queued == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("expected %v queued requests", count)
+}
+
+type acquireResult struct {
+	idx   int
+	lease Lease
+	err   error
+}
+
+func acquireAsync(c *Controller, ctx context.Context, idx int, route Route, results chan<- acquireResult) {
+	go func() {
+		lease, err := c.AcquireLivePort(ctx, route)
+		results <- acquireResult{idx: idx, lease: lease, err: err}
+	}()
+}
+
+func TestAcquireServesQueueInOrder(t *testing.T) {
+	c := newQueueController(Options{MaxConcurrency: 1}, currentProcess(1, 1))
+
+	held, err := c.AcquireLivePort(context.Background(), Route{})
+	if err != nil {
+		t.Fatalf("failed to acquire first lease: %v", err)
+	}
+
+	results := make(chan acquireResult)
+	for idx := 0; idx < 3; idx++ {
+		acquireAsync(c, context.Background(), idx, Route{}, results)
+		waitQueued(t, c, idx+1)
+	}
+
+	c.ReleasePort(held.Port)
+	for expected := 0; expected < 3; expected++ {
+		result := <-results
+		if result.err != nil {
+			t.Fatalf("queued request %v failed: %v", result.idx, result.err)
+		}
+		if result.idx != expected {
+			t.Fatalf("expected queued request %v to be served, got %v", expected, result.idx)
+		}
+		c.ReleasePort(result.lease.Port)
+	}
+}
+
+func TestAcquireRejectsWaiters(t *testing.T) {
+	cases := []struct {
+		name    string
+		options Options
+		queued  int
+		cancel  bool
+		err     error
+	}{
+		{
+			name:    "full queue",
+			options: Options{MaxQueueDepth: 2},
+			queued:  2,
+			err:     ErrQueueFull,
+		},
+		{
+			name:    "max wait",
+			options: Options{MaxQueueWait: 10 * time.Millisecond},
+			err:     ErrQueueTimeout,
+		},
+		{
+			name:    "cancelled request",
+			options: Options{},
+			cancel:  true,
+			err:     context.Canceled,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newQueueController(tc.options, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			results := make(chan acquireResult, tc.queued+1)
+			for idx := 0; idx < tc.queued; idx++ {
+				acquireAsync(c, ctx, idx, Route{}, results)
+				waitQueued(t, c, idx+1)
+			}
+
+			acquireAsync(c, ctx, tc.queued, Route{}, results)
+			if tc.cancel {
+				waitQueued(t, c, tc.queued+1)
+				cancel()
+			}
+
+			result := <-results
+			if !errors.Is(result.err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, result.err)
+			}
+
+			// Waiters that gave up must leave the queue, the others keep waiting.
+			waitQueued(t, c, tc.queued)
+		})
+	}
+}
+
+func TestAcquireDoesNotQueueBehindOtherRoutes(t *testing.T) {
+	c := newQueueController(Options{}, currentProcess(1, 1))
+	c.warm[2] = &Process{port: 2, version: 2, state: STATE_STARTING}
+
+	version := int64(2)
+	results := make(chan acquireResult, 1)
+	acquireAsync(c, context.Background(), 0, Route{Version: &version}, results)
+	waitQueued(t, c, 1)
+
+	lease, err := c.AcquireLivePort(context.Background(), Route{})
+	if err != nil {
+		t.Fatalf("failed to acquire current process: %v", err)
+	}
+	if lease.Port != 1 {
+		t.Fatalf("expected port 1, got %v", lease.Port)
+	}
+}
+
+func TestUpgradedConnectionsFreeConcurrency(t *testing.T) {
+	c := newQueueController(Options{MaxConcurrency: 1}, currentProcess(1, 1))
+
+	upgraded, err := c.AcquireLivePort(context.Background(), Route{})
+	if err != nil {
+		t.Fatalf("failed to acquire first lease: %v", err)
+	}
+
+	results := make(chan acquireResult, 1)
+	acquireAsync(c, context.Background(), 0, Route{}, results)
+	waitQueued(t, c, 1)
+
+	c.UpgradePort(upgraded.Port)
+	result := <-results
+	if result.err != nil {
+		t.Fatalf("queued request failed: %v", result.err)
+	}
+
+	c.procMutex.RLock()
+	inFlight := c.inFlightLocked()
+	c.procMutex.RUnlock()
+	if inFlight != 2 {
+		t.Fatalf("expected upgraded connection to stay in flight, got %v requests", inFlight)
+	}
+
+	c.ReleaseUpgradedPort(upgraded.Port)
+	c.ReleasePort(result.lease.Port)
+	if len(c.counters) != 0 || len(c.upgrades) != 0 {
+		t.Fatalf("expected every lease to be released, got %v and %v", c.counters, c.upgrades)
+	}
+}
+
+func TestStatusCountsQueuedRequestsOnce(t *testing.T) {
+	current := currentProcess(1, 1)
+	current.cmd = &exec.Cmd{Process: &os.Process{Pid: 1}}
+	c := newQueueController(Options{MaxConcurrency: 1}, current)
+
+	held, err := c.AcquireLivePort(context.Background(), Route{})
+	if err != nil {
+		t.Fatalf("failed to acquire first lease: %v", err)
+	}
+
+	results := make(chan acquireResult, 1)
+	acquireAsync(c, context.Background(), 0, Route{}, results)
+	waitQueued(t, c, 1)
+
+	status := c.Status()
+	if status.InFlight != 1 || status.Queued != 1 {
+		t.Fatalf("expected 1 in flight and 1 queued, got %v and %v", status.InFlight, status.Queued)
+	}
+
+	c.ReleasePort(held.Port)
+	result := <-results
+	c.ReleasePort(result.lease.Port)
+
+	c.procMutex.RLock()
+	idle := c.idleLocked()
+	c.procMutex.RUnlock()
+	if idle == 0 {
+		t.Fatalf("expected the sandbox to be idle once every request was served")
+	}
+}
@@ -0,0 +1,203 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	dlc "github.com/gadget-inc/dateilager/pkg/client"
+	"go.uber.org/zap"
+)
+
+const (
+	RELOAD_TIMEOUT = 5 * time.Second
+)
+
+type ReloadRequest struct {
+	Version int64    `json:"version"`
+	Paths   []string `json:"paths"`
+}
+
+func validateGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		_, err := path.Match(segment, "")
+		if err != nil {
+			return fmt.Errorf("invalid restart pattern %v: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob matches name against pattern one path segment at a time, "**" matches any number of segments
+// and patterns without a "/" only match the base name.
+func matchGlob(pattern, name string) bool {
+	name = strings.Trim(name, "/")
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(name))
+		return matched
+	}
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for idx := 0; idx <= len(segments); idx++ {
+				if matchSegments(pattern[1:], segments[idx:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		matched, _ := path.Match(pattern[0], segments[0])
+		if !matched {
+			return false
+		}
+
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+
+	return len(segments) == 0
+}
+
+func requiresRestart(patterns []string, name string) bool {
+	if strings.Trim(name, "/") == MANIFEST_FILE {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload updates the current process's workdir to the target version in place when none of the changed
+// files match its restart patterns. It returns a nil process when the version needs a new process instead.
+func (c *Controller) reload(ctx context.Context, targetVersion *int64) (*Process, error) {
+	c.procMutex.RLock()
+	current := c.current
+	c.procMutex.RUnlock()
+
+	if current == nil || len(current.command.RestartPatterns) == 0 {
+		return nil, nil
+	}
+
+	from := current.Version()
+	to := int64(-1)
+	if targetVersion != nil {
+		to = *targetVersion
+	} else {
+		inspect, err := c.dlClient.Inspect(ctx, c.project)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch latest version: %w", err)
+		}
+		to = inspect.LatestVersion
+	}
+
+	if to <= from {
+		return nil, nil
+	}
+
+	// Other processes of the same version, such as one draining after a restart, share the workdir and
+	// must keep running from its files.
+	if !c.workDirs.Exclusive(current.command.WorkDir) {
+		c.log.Info("workdir is shared, restarting instead", zap.Int("port", current.port), zap.String("dir", current.command.WorkDir))
+		return nil, nil
+	}
+
+	objects, err := c.dlClient.Get(ctx, c.project, "", nil, dlc.VersionRange{From: &from, To: &to})
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff version %v to %v: %w", from, to, err)
+	}
+
+	log := c.log.With(zap.Int("port", current.port), zap.Int64("from", from), zap.Int64("to", to))
+
+	paths := make([]string, len(objects))
+	for idx, object := range objects {
+		if requiresRestart(current.command.RestartPatterns, object.Path) {
+			log.Info("version requires a restart", zap.String("path", object.Path))
+			return nil, nil
+		}
+		paths[idx] = object.Path
+	}
+
+	err = c.workDirs.Update(ctx, c.dlClient, c.project, current.command.WorkDir, to)
+	if err != nil {
+		// The current process keeps serving from the partially updated workdir until a fresh build replaces it.
+		log.Warn("failed to update workdir in place, restarting instead", zap.Error(err))
+		return nil, nil
+	}
+
+	c.procMutex.Lock()
+	current.setVersionLocked(to)
+	reloaded := current == c.current
+	c.procMutex.Unlock()
+
+	// The process exited while its workdir was updated, a new one is booted from the updated workdir.
+	if !reloaded {
+		return nil, nil
+	}
+
+	log.Info("hot reloaded process", zap.Int("files", len(paths)))
+	c.events.Emit(EVENT_RELOADED, to, current.port, fmt.Sprintf("reloaded %v files from version %v", len(paths), from))
+	c.notifyReload(current, to, paths)
+
+	return current, nil
+}
+
+// notifyReload tells a hot reloaded process which files changed, failures are only logged as the files
+// have already been updated.
+func (c *Controller) notifyReload(proc *Process, version int64, paths []string) {
+	log := c.log.With(zap.Int("port", proc.port), zap.Int64("version", version))
+
+	if proc.command.ReloadSignal != 0 {
+		err := proc.Signal(proc.command.ReloadSignal)
+		if err != nil {
+			log.Warn("failed to signal reloaded process", zap.Error(err))
+		}
+	}
+
+	if proc.command.ReloadPath == "" {
+		return
+	}
+
+	body, err := json.Marshal(ReloadRequest{Version: version, Paths: paths})
+	if err != nil {
+		log.Warn("failed to marshal reload request", zap.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, RELOAD_TIMEOUT)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s:%d%s", c.Host, proc.port, proc.command.ReloadPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Warn("failed to create reload request", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Transport: c.checkTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warn("failed to notify reloaded process", zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Warn("reloaded process rejected notification", zap.Int("status", resp.StatusCode))
+	}
+}
@@ -0,0 +1,107 @@
+package sandbox
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{pattern: "*.mjs", name: "script.mjs", matched: true},
+		{pattern: "*.mjs", name: "src/lib/util.mjs", matched: true},
+		{pattern: "*.mjs", name: "styles.css", matched: false},
+		{pattern: "package.json", name: "/package.json", matched: true},
+		{pattern: "src/*.mjs", name: "src/index.mjs", matched: true},
+		{pattern: "src/*.mjs", name: "src/lib/util.mjs", matched: false},
+		{pattern: "src/*.mjs", name: "index.mjs", matched: false},
+		{pattern: "src/**", name: "src/lib/util.mjs", matched: true},
+		{pattern: "src/**", name: "src", matched: true},
+		{pattern: "src/**/*.mjs", name: "src/index.mjs", matched: true},
+		{pattern: "src/**/*.mjs", name: "src/a/b/c.mjs", matched: true},
+		{pattern: "src/**/*.mjs", name: "lib/a/c.mjs", matched: false},
+		{pattern: "**/config/*", name: "app/config/db.json", matched: true},
+		{pattern: "/src/*", name: "src/index.mjs", matched: true},
+	}
+
+	for _, tc := range cases {
+		matched := matchGlob(tc.pattern, tc.name)
+		if matched != tc.matched {
+			t.Errorf("expected matchGlob(%q, %q) to be %v", tc.pattern, tc.name, tc.matched)
+		}
+	}
+}
+
+func TestRequiresRestart(t *testing.T) {
+	patterns := []string{"package.json", "src/server/**"}
+
+	cases := []struct {
+		name     string
+		required bool
+	}{
+		{name: MANIFEST_FILE, required: true},
+		{name: "/" + MANIFEST_FILE, required: true},
+		{name: "package.json", required: true},
+		{name: "src/server/routes/index.mjs", required: true},
+		{name: "src/client/app.mjs", required: false},
+		{name: "public/fusion.json", required: false},
+	}
+
+	for _, tc := range cases {
+		required := requiresRestart(patterns, tc.name)
+		if required != tc.required {
+			t.Errorf("expected requiresRestart(%q) to be %v", tc.name, tc.required)
+		}
+	}
+
+	if !requiresRestart(nil, MANIFEST_FILE) {
+		t.Errorf("expected manifest changes to restart without patterns")
+	}
+}
+
+func TestValidateGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		valid   bool
+	}{
+		{pattern: "*.mjs", valid: true},
+		{pattern: "src/**/[a-z]*.mjs", valid: true},
+		{pattern: "src/[", valid: false},
+		{pattern: "[a-", valid: false},
+		{pattern: `src\`, valid: false},
+	}
+
+	for _, tc := range cases {
+		err := validateGlob(tc.pattern)
+		if (err == nil) != tc.valid {
+			t.Errorf("expected validateGlob(%q) valid to be %v, got %v", tc.pattern, tc.valid, err)
+		}
+	}
+}
+
+func TestWorkDirsExclusive(t *testing.T) {
+	workDirs, err := NewWorkDirs(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create workdirs: %v", err)
+	}
+
+	dir := "v1"
+	workDirs.Acquire(dir)
+	if !workDirs.Exclusive(dir) {
+		t.Fatalf("expected a workdir used by one process to be exclusive")
+	}
+
+	workDirs.Acquire(dir)
+	if workDirs.Exclusive(dir) {
+		t.Fatalf("expected a workdir used by two processes to be shared")
+	}
+
+	workDirs.Release(dir)
+	if !workDirs.Exclusive(dir) {
+		t.Fatalf("expected a released workdir to be exclusive again")
+	}
+}
@@ -0,0 +1,166 @@
+package sandbox
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type RestartPolicy string
+
+const (
+	RESTART_ALWAYS     RestartPolicy = "always"
+	RESTART_ON_FAILURE RestartPolicy = "on-failure"
+	RESTART_NEVER      RestartPolicy = "never"
+)
+
+const (
+	RESTART_BACKOFF_START = 500 * time.Millisecond
+	RESTART_BACKOFF_MAX   = 30 * time.Second
+	RESTART_RESET_AFTER   = time.Minute
+	CRASH_LOOP_RESTARTS   = 5
+
+	LIVENESS_INTERVAL = 5 * time.Second
+	LIVENESS_TIMEOUT  = 2 * time.Second
+	LIVENESS_FAILURES = 3
+)
+
+func ParseRestartPolicy(policy string) (RestartPolicy, error) {
+	switch RestartPolicy(policy) {
+	case RESTART_ALWAYS, RESTART_ON_FAILURE, RESTART_NEVER:
+		return RestartPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown restart policy %v", policy)
+	}
+}
+
+func (r RestartPolicy) shouldRestart(status *ExitStatus) bool {
+	switch r {
+	case RESTART_ALWAYS:
+		return true
+	case RESTART_ON_FAILURE:
+		return status.Reason != EXIT_REASON_EXITED
+	default:
+		return false
+	}
+}
+
+func restartBackoff(restarts int) time.Duration {
+	backoff := RESTART_BACKOFF_START
+	for idx := 1; idx < restarts; idx++ {
+		backoff *= 2
+		if backoff >= RESTART_BACKOFF_MAX {
+			return RESTART_BACKOFF_MAX
+		}
+	}
+	return backoff
+}
+
+// applyRestartPolicyLocked is called once the current process has exited and decides whether to respawn it.
+func (c *Controller) applyRestartPolicyLocked(proc *Process, status *ExitStatus) bool {
+	log := c.log.With(zap.Int("port", proc.port), zap.Int64("version", proc.version), zap.String("reason", string(status.Reason)))
+
+	if !proc.command.Restart.shouldRestart(status) {
+		log.Warn("current process exited, not restarting", zap.String("policy", string(proc.command.Restart)))
+		c.crashErr = fmt.Errorf("process for version %v %v with code %v", proc.version, status.Reason, status.Code)
+		c.broadcastLocked()
+		return false
+	}
+
+	// Hot reloads change the version without a promotion.
+	if proc.version != c.restartsVersion || time.Since(proc.promotedAt) > RESTART_RESET_AFTER {
+		c.restarts = 0
+		c.restartsVersion = proc.version
+	}
+	c.restarts += 1
+
+	if c.restarts > CRASH_LOOP_RESTARTS {
+		log.Error("current process is crash looping", zap.Int("restarts", c.restarts-1))
+		c.crashErr = fmt.Errorf("process for version %v is crash looping after %v restarts", proc.version, c.restarts-1)
+		c.broadcastLocked()
+		return false
+	}
+
+	backoff := restartBackoff(c.restarts)
+	log.Warn("current process exited, restarting", zap.Int("restarts", c.restarts), zap.Duration("backoff", backoff))
+
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		err := c.restart(proc)
+		if err != nil {
+			c.log.Error("failed to restart process", zap.Int64("version", proc.Version()), zap.Error(err))
+		}
+	}()
+
+	return true
+}
+
+// restart respawns the version of a crashed process on a fresh port, unless a deploy has started or the sandbox
+// was drained in the meantime.
+func (c *Controller) restart(crashed *Process) error {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+	defer c.workDirs.Release(crashed.command.WorkDir)
+
+	if c.next != nil || c.current != nil || c.crashErr != nil {
+		return nil
+	}
+
+	proc, err := c.newProcessLocked(crashed.command, crashed.version)
+	if err != nil {
+		return err
+	}
+
+	return c.startNextLocked(proc)
+}
+
+// checkLiveness kills the current process after LIVENESS_FAILURES consecutive failed health checks,
+// its exit is then handled by the restart policy.
+func (c *Controller) checkLiveness() {
+	client := &http.Client{
+		Timeout:   LIVENESS_TIMEOUT,
+		Transport: c.checkTransport,
+	}
+
+	var tracked *Process
+	failures := 0
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(LIVENESS_INTERVAL):
+		}
+
+		c.procMutex.RLock()
+		current := c.current
+		c.procMutex.RUnlock()
+
+		if current != tracked {
+			tracked = current
+			failures = 0
+		}
+		if current == nil {
+			continue
+		}
+
+		if healthCheck(c.ctx, client, c.Host, current) {
+			failures = 0
+			continue
+		}
+
+		failures += 1
+		if failures == LIVENESS_FAILURES {
+			c.log.Warn("current process failed liveness checks, killing", zap.Int("port", current.port), zap.Int("failures", failures))
+			current.markUnhealthy()
+			go current.Kill()
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type ProcessState string
+
+// Processes move through these states in order, STATE_FAILED can be reached from any running state. Warm
+// processes stay in STATE_WARM once healthy until they're promoted or drained.
+const (
+	STATE_STARTING ProcessState = "starting"
+	STATE_HEALTHY  ProcessState = "healthy"
+	STATE_WARM     ProcessState = "warm"
+	STATE_CURRENT  ProcessState = "current"
+	STATE_DRAINING ProcessState = "draining"
+	STATE_STOPPED  ProcessState = "stopped"
+	STATE_FAILED   ProcessState = "failed"
+)
+
+const (
+	HEALTH_BACKOFF_START = 50 * time.Millisecond
+	HEALTH_BACKOFF_MAX   = time.Second
+	HEALTH_TIMEOUT       = 2 * time.Second
+)
+
+// broadcastLocked wakes every goroutine waiting on a state change and serves the queued requests that can now
+// be routed.
+func (c *Controller) broadcastLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.dispatchLocked()
+}
+
+func (c *Controller) setStateLocked(proc *Process, state ProcessState) {
+	if proc.state == state {
+		return
+	}
+
+	c.log.Info("process state", zap.Int("port", proc.port), zap.Int64("version", proc.version),
+		zap.String("from", string(proc.state)), zap.String("to", string(state)))
+
+	proc.state = state
+	c.broadcastLocked()
+}
+
+// startNextLocked runs proc and installs it as the next process, which is promoted once healthy.
+func (c *Controller) startNextLocked(proc *Process) error {
+	err := c.launchLocked(proc)
+	if err != nil {
+		return err
+	}
+
+	c.next = proc
+	return nil
+}
+
+// launchLocked runs proc and supervises it until it's healthy, its port, workdir and cgroup are released if
+// it fails to run. Callers install it as the next or a warm process while still holding procMutex.
+func (c *Controller) launchLocked(proc *Process) error {
+	err := proc.Run(c.ctx)
+	if err != nil {
+		c.ports.Release(proc.port)
+		c.workDirs.Release(proc.command.WorkDir)
+		if proc.cgroup != nil {
+			proc.cgroup.Remove()
+		}
+		return err
+	}
+
+	c.setStateLocked(proc, STATE_STARTING)
+
+	go c.awaitHealthy(proc)
+	go c.supervise(proc)
+
+	return nil
+}
+
+// stopLocked kills a process that is no longer next, current or graceful in the background.
+func (c *Controller) stopLocked(proc *Process) {
+	go func() {
+		err := proc.Kill()
+		if err != nil {
+			c.log.Error("failed to kill process", zap.Int("port", proc.port), zap.Error(err))
+		}
+	}()
+}
+
+// awaitHealthy polls the health endpoint of a starting process with exponential backoff and promotes it
+// once it responds successfully, warm processes are only marked as ready to serve.
+func (c *Controller) awaitHealthy(proc *Process) {
+	client := &http.Client{
+		Timeout:   HEALTH_TIMEOUT,
+		Transport: c.checkTransport,
+	}
+	delay := HEALTH_BACKOFF_START
+	deadline := time.After(proc.command.StartTimeout)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-proc.Done():
+			return
+		case <-deadline:
+			c.failStart(proc, fmt.Sprintf("not healthy after %v", proc.command.StartTimeout))
+			return
+		case <-time.After(delay):
+		}
+
+		c.procMutex.RLock()
+		pending := c.next == proc || c.warm[proc.version] == proc
+		c.procMutex.RUnlock()
+
+		if !pending {
+			return
+		}
+
+		if healthCheck(c.ctx, client, c.Host, proc) {
+			c.markHealthy(proc)
+			return
+		}
+
+		delay *= 2
+		if delay > HEALTH_BACKOFF_MAX {
+			delay = HEALTH_BACKOFF_MAX
+		}
+	}
+}
+
+// failStart kills a next or warm process that didn't become healthy in time, leaving the current process serving.
+func (c *Controller) failStart(proc *Process, reason string) {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	switch proc {
+	case c.next:
+		c.next = nil
+	case c.warm[proc.version]:
+		c.removeWarmLocked(proc)
+	default:
+		return
+	}
+
+	c.recordFailureLocked(proc, reason)
+	c.setStateLocked(proc, STATE_FAILED)
+	c.stopLocked(proc)
+}
+
+func (c *Controller) recordFailureLocked(proc *Process, reason string) {
+	proc.failure = &StartFailure{
+		Version: proc.version,
+		Port:    proc.port,
+		Reason:  reason,
+		Stderr:  proc.StderrTail(),
+		At:      time.Now(),
+	}
+	c.lastFailure = proc.failure
+
+	c.events.Emit(EVENT_START_FAILED, proc.version, proc.port, reason)
+	c.log.Warn("version failed to start", zap.Int64("version", proc.version), zap.Int("port", proc.port),
+		zap.String("reason", reason), zap.Strings("stderr", proc.failure.Stderr))
+}
+
+// markHealthy promotes a healthy next process, or marks a warm process as ready to serve.
+func (c *Controller) markHealthy(proc *Process) {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	// The process may have been replaced by a newer version while its health check was in flight.
+	switch proc {
+	case c.next:
+		c.setStateLocked(proc, STATE_HEALTHY)
+		c.events.Emit(EVENT_HEALTHY, proc.version, proc.port, "")
+		c.promoteLocked(proc)
+	case c.warm[proc.version]:
+		c.setStateLocked(proc, STATE_WARM)
+		c.events.Emit(EVENT_HEALTHY, proc.version, proc.port, "warm")
+	}
+}
+
+// promoteLocked makes a healthy next process current and starts draining the previous current.
+func (c *Controller) promoteLocked(proc *Process) {
+	if c.current != nil {
+		old := c.current
+		c.gracefuls = append(c.gracefuls, old)
+		c.setStateLocked(old, STATE_DRAINING)
+		go c.drain(old)
+	}
+
+	c.current = proc
+	c.current.promotedAt = time.Now()
+	c.next = nil
+	c.crashErr = nil
+
+	// A new version starts with a clean slate, even when the previous one was crash looping.
+	if proc.version != c.restartsVersion {
+		c.restarts = 0
+		c.restartsVersion = proc.version
+	}
+	c.setStateLocked(proc, STATE_CURRENT)
+	c.events.Emit(EVENT_PROMOTED, proc.version, proc.port, "")
+}
+
+// drain waits for the last in-flight request of a draining process to finish before killing it.
+func (c *Controller) drain(proc *Process) {
+	for {
+		c.procMutex.RLock()
+		remaining := c.counters[proc.port]
+		changed := c.changed
+		c.procMutex.RUnlock()
+
+		if remaining == 0 {
+			break
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-proc.Done():
+			return
+		case <-changed:
+		}
+	}
+
+	err := proc.Kill()
+	if err != nil {
+		c.log.Error("failed to kill drained process", zap.Int("port", proc.port), zap.Error(err))
+	}
+}
+
+// supervise waits for a process to exit and moves it to its final state.
+func (c *Controller) supervise(proc *Process) {
+	select {
+	case <-c.ctx.Done():
+		return
+	case <-proc.Done():
+	}
+
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	c.ports.Release(proc.port)
+
+	c.history = append(c.history, proc)
+	if len(c.history) > PROCESS_HISTORY {
+		c.history = c.history[1:]
+	}
+
+	status := proc.ExitStatus()
+	final := STATE_STOPPED
+	switch status.Reason {
+	case EXIT_REASON_FAILED, EXIT_REASON_UNHEALTHY, EXIT_REASON_OOM:
+		final = STATE_FAILED
+	}
+
+	switch proc {
+	case c.next:
+		c.next = nil
+		c.recordFailureLocked(proc, fmt.Sprintf("%v with code %v before becoming healthy", status.Reason, status.Code))
+		c.setStateLocked(proc, STATE_FAILED)
+		c.workDirs.Release(proc.command.WorkDir)
+
+	case c.warm[proc.version]:
+		c.removeWarmLocked(proc)
+		if proc.state == STATE_STARTING {
+			c.recordFailureLocked(proc, fmt.Sprintf("%v with code %v before becoming healthy", status.Reason, status.Code))
+			final = STATE_FAILED
+		}
+		c.setStateLocked(proc, final)
+		c.workDirs.Release(proc.command.WorkDir)
+
+	case c.current:
+		c.current = nil
+		c.setStateLocked(proc, final)
+		c.events.Emit(EVENT_CRASHED, proc.version, proc.port, fmt.Sprintf("%v with code %v", status.Reason, status.Code))
+		// A restarted process reuses the workdir, which is released once the restart has been attempted.
+		if !c.applyRestartPolicyLocked(proc, status) {
+			c.workDirs.Release(proc.command.WorkDir)
+		}
+
+	default:
+		for index, oldProc := range c.gracefuls {
+			if oldProc == proc {
+				c.gracefuls = append(c.gracefuls[:index], c.gracefuls[index+1:]...)
+				break
+			}
+		}
+		if proc.state == STATE_DRAINING {
+			c.events.Emit(EVENT_DRAINED, proc.version, proc.port, "")
+		}
+		if proc.state != STATE_FAILED {
+			c.setStateLocked(proc, final)
+		}
+		c.workDirs.Release(proc.command.WorkDir)
+	}
+}
+
+func healthCheck(ctx context.Context, client *http.Client, host string, proc *Process) bool {
+	url := fmt.Sprintf("http://%s:%d%s", host, proc.port, proc.command.HealthPath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
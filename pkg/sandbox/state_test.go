@@ -0,0 +1,210 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newStateController(t *testing.T) *Controller {
+	t.Helper()
+
+	workDirs, err := NewWorkDirs(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create workdirs: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	c := newQueueController(Options{}, nil)
+	c.ctx = ctx
+	c.ports = NewPortAllocator("127.0.0.1", 0, 0, "")
+	c.workDirs = workDirs
+	c.logs = NewLogHub()
+	c.events = NewEventLog()
+	return c
+}
+
+// runStateProcess runs script in its own workdir, as a version would, and kills it when the test ends.
+func runStateProcess(t *testing.T, c *Controller, port int, version int64, script string) *Process {
+	t.Helper()
+
+	dir := filepath.Join(c.workDirs.root, fmt.Sprintf("v%d-%d", version, port))
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatalf("failed to create workdir: %v", err)
+	}
+	c.workDirs.Acquire(dir)
+
+	command := NewCommand("sh", []string{"-c", script}, dir)
+	command.StopTimeout = time.Second
+
+	proc := NewProcess(zap.NewNop(), c.logs, command, port, "", version)
+	err = proc.Run(c.ctx)
+	if err != nil {
+		t.Fatalf("failed to run process: %v", err)
+	}
+	t.Cleanup(func() { proc.Kill() })
+
+	return proc
+}
+
+func waitState(t *testing.T, c *Controller, proc *Process, state ProcessState) {
+	t.Helper()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		c.procMutex.RLock()
+		current := proc.state
+		changed := c.changed
+		c.procMutex.RUnlock()
+
+		if current == state {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("expected process %v to be %v, got %v", proc.port, state, current)
+		}
+	}
+}
+
+func TestMarkHealthyPromotesNextAndDrainsCurrent(t *testing.T) {
+	c := newStateController(t)
+
+	old := runStateProcess(t, c, 1, 1, "sleep 30")
+	c.current = old
+	old.state = STATE_CURRENT
+	go c.supervise(old)
+
+	next := runStateProcess(t, c, 2, 2, "sleep 30")
+	c.next = next
+	next.state = STATE_STARTING
+
+	// A request still in flight on the old process holds it in the draining state.
+	c.counters[old.port] = 1
+
+	c.markHealthy(next)
+
+	c.procMutex.RLock()
+	if c.current != next || c.next != nil {
+		t.Fatalf("expected the next process to be promoted")
+	}
+	if next.state != STATE_CURRENT {
+		t.Fatalf("expected the promoted process to be current, got %v", next.state)
+	}
+	if len(c.gracefuls) != 1 || c.gracefuls[0] != old || old.state != STATE_DRAINING {
+		t.Fatalf("expected the previous process to be draining")
+	}
+	c.procMutex.RUnlock()
+
+	select {
+	case <-old.Done():
+		t.Fatalf("expected the draining process to wait for its in-flight request")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.ReleasePort(old.port)
+	waitState(t, c, old, STATE_STOPPED)
+
+	c.procMutex.RLock()
+	defer c.procMutex.RUnlock()
+
+	if len(c.gracefuls) != 0 {
+		t.Fatalf("expected the drained process to be forgotten, got %v gracefuls", len(c.gracefuls))
+	}
+	if c.current != next {
+		t.Fatalf("expected the promoted process to keep serving")
+	}
+}
+
+func TestMarkHealthyIgnoresReplacedNext(t *testing.T) {
+	c := newStateController(t)
+	c.current = currentProcess(1, 1)
+
+	replaced := &Process{port: 2, version: 2, state: STATE_STARTING}
+	c.next = &Process{port: 3, version: 3, state: STATE_STARTING}
+
+	c.markHealthy(replaced)
+
+	if c.current.version != 1 || c.next.version != 3 {
+		t.Fatalf("expected a replaced process to be ignored")
+	}
+	if replaced.state != STATE_STARTING {
+		t.Fatalf("expected a replaced process to keep its state, got %v", replaced.state)
+	}
+}
+
+func TestFailStartKeepsCurrent(t *testing.T) {
+	c := newStateController(t)
+	current := currentProcess(1, 1)
+	c.current = current
+
+	next := runStateProcess(t, c, 2, 2, "sleep 30")
+	c.next = next
+	next.state = STATE_STARTING
+	go c.supervise(next)
+
+	c.failStart(next, "not healthy")
+
+	c.procMutex.RLock()
+	if c.current != current || current.state != STATE_CURRENT {
+		t.Fatalf("expected the current process to keep serving")
+	}
+	if c.next != nil || next.state != STATE_FAILED {
+		t.Fatalf("expected the next process to fail, got %v", next.state)
+	}
+	if c.lastFailure == nil || c.lastFailure.Version != 2 || c.lastFailure.Reason != "not healthy" {
+		t.Fatalf("expected the failure to be recorded, got %v", c.lastFailure)
+	}
+	c.procMutex.RUnlock()
+
+	select {
+	case <-next.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the failed process to be killed")
+	}
+
+	// The failed state is final, supervise doesn't move the killed process to stopped.
+	time.Sleep(50 * time.Millisecond)
+	c.procMutex.RLock()
+	defer c.procMutex.RUnlock()
+
+	if next.state != STATE_FAILED {
+		t.Fatalf("expected the killed process to stay failed, got %v", next.state)
+	}
+}
+
+func TestSuperviseFailsNextThatExits(t *testing.T) {
+	c := newStateController(t)
+	current := currentProcess(1, 1)
+	c.current = current
+
+	next := runStateProcess(t, c, 2, 2, "exit 1")
+	c.next = next
+	next.state = STATE_STARTING
+	go c.supervise(next)
+
+	waitState(t, c, next, STATE_FAILED)
+
+	c.procMutex.RLock()
+	defer c.procMutex.RUnlock()
+
+	if c.next != nil || c.current != current {
+		t.Fatalf("expected the current process to keep serving")
+	}
+	if c.lastFailure == nil || c.lastFailure.Version != 2 {
+		t.Fatalf("expected the exit to be recorded as a start failure, got %v", c.lastFailure)
+	}
+	if len(c.history) != 1 || c.history[0] != next {
+		t.Fatalf("expected the exited process to be kept in the history")
+	}
+}
@@ -0,0 +1,287 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+const (
+	MAX_WARM_VERSIONS = 3
+)
+
+var (
+	ErrVersionUnavailable = errors.New("version is not warm")
+	ErrTooManyWarm        = fmt.Errorf("at most %v versions can be kept warm", MAX_WARM_VERSIONS)
+	ErrInvalidSplit       = errors.New("invalid traffic split")
+)
+
+// Route selects the process that serves a request.
+type Route struct {
+	// Pending routes to the next process while it boots.
+	Pending bool
+
+	// Version pins the request to the current, next or a warm process of that version. Sticky pins fall back
+	// to the default routing when the version isn't running anymore, others fail with ErrVersionUnavailable.
+	Version *int64
+	Sticky  bool
+}
+
+// Lease is a request counted against a process, it must be released with ReleasePort.
+type Lease struct {
+	Port    int
+	Version int64
+
+	// Split is set when the version was picked by the traffic split, so the client can be pinned to it.
+	Split bool
+}
+
+// Warm boots version alongside the current process and waits for it to become healthy. Warm versions only
+// receive requests pinned to them or sent their way by the traffic split.
+func (c *Controller) Warm(ctx context.Context, version int64) error {
+	proc, err := c.startWarm(ctx, version)
+	if err != nil || proc == nil {
+		return err
+	}
+
+	return c.awaitWarm(ctx, proc)
+}
+
+func (c *Controller) startWarm(ctx context.Context, version int64) (*Process, error) {
+	c.startMutex.Lock()
+	defer c.startMutex.Unlock()
+
+	c.procMutex.Lock()
+	if c.current != nil && c.current.version == version {
+		c.procMutex.Unlock()
+		return nil, nil
+	}
+	if proc, ok := c.warm[version]; ok {
+		c.procMutex.Unlock()
+		return proc, nil
+	}
+	if len(c.warm) >= MAX_WARM_VERSIONS {
+		c.procMutex.Unlock()
+		return nil, ErrTooManyWarm
+	}
+	c.procMutex.Unlock()
+
+	c.emitRebuildStarted(&version)
+	workDir, _, err := c.workDirs.Build(ctx, c.dlClient, c.project, &version)
+	if err != nil {
+		c.events.Emit(EVENT_START_FAILED, version, 0, err.Error())
+		return nil, err
+	}
+	c.events.Emit(EVENT_REBUILD_FINISHED, version, 0, workDir)
+
+	command, err := LoadCommand(workDir, c.command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load command for version %v: %w", version, err)
+	}
+
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	proc, err := c.newProcessLocked(command, version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.launchLocked(proc)
+	if err != nil {
+		return nil, err
+	}
+
+	c.warm[version] = proc
+	return proc, nil
+}
+
+func (c *Controller) awaitWarm(ctx context.Context, proc *Process) error {
+	for {
+		c.procMutex.RLock()
+		state := proc.state
+		failure := proc.failure
+		changed := c.changed
+		c.procMutex.RUnlock()
+
+		switch state {
+		case STATE_WARM, STATE_CURRENT:
+			return nil
+		case STATE_DRAINING, STATE_STOPPED, STATE_FAILED:
+			if failure != nil {
+				return failure
+			}
+			return fmt.Errorf("version %v was stopped before becoming healthy: %w", proc.version, ErrVersionUnavailable)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Unwarm stops routing to a warm version and drains it.
+func (c *Controller) Unwarm(version int64) error {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	proc, ok := c.warm[version]
+	if !ok {
+		return fmt.Errorf("cannot unwarm version %v: %w", version, ErrVersionUnavailable)
+	}
+
+	c.removeWarmLocked(proc)
+	c.gracefuls = append(c.gracefuls, proc)
+	c.setStateLocked(proc, STATE_DRAINING)
+	go c.drain(proc)
+
+	return nil
+}
+
+// SetSplit sends the given percentage of unpinned requests to each warm version, the remainder is served
+// by the current process. An empty split sends everything to the current process.
+func (c *Controller) SetSplit(weights map[int64]int) error {
+	c.procMutex.Lock()
+	defer c.procMutex.Unlock()
+
+	total := 0
+	for version, weight := range weights {
+		if weight < 0 || weight > 100 {
+			return fmt.Errorf("%w: weight %v of version %v isn't a percentage", ErrInvalidSplit, weight, version)
+		}
+		if _, ok := c.warm[version]; !ok {
+			return fmt.Errorf("cannot split traffic to version %v: %w", version, ErrVersionUnavailable)
+		}
+		total += weight
+	}
+	if total > 100 {
+		return fmt.Errorf("%w: weights add up to %v%%", ErrInvalidSplit, total)
+	}
+
+	c.split = make(map[int64]int, len(weights))
+	for version, weight := range weights {
+		if weight > 0 {
+			c.split[version] = weight
+		}
+	}
+
+	c.log.Info("set traffic split", zap.Any("weights", c.split))
+	c.broadcastLocked()
+
+	return nil
+}
+
+func (c *Controller) removeWarmLocked(proc *Process) {
+	delete(c.warm, proc.version)
+	delete(c.split, proc.version)
+}
+
+// warmLocked returns the warm processes ordered by version.
+func (c *Controller) warmLocked() []*Process {
+	procs := make([]*Process, 0, len(c.warm))
+	for _, proc := range c.warm {
+		procs = append(procs, proc)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].version < procs[j].version })
+	return procs
+}
+
+// promoteWarmLocked installs the warm process of version as the next process, it's promoted straight away
+// when it's already healthy and once its health check passes otherwise.
+func (c *Controller) promoteWarmLocked(version int64) *Process {
+	proc, ok := c.warm[version]
+	if !ok {
+		return nil
+	}
+
+	c.log.Info("promoting warm process", zap.Int("port", proc.port), zap.Int64("version", version))
+
+	c.removeWarmLocked(proc)
+	c.next = proc
+	if proc.state == STATE_WARM {
+		c.promoteLocked(proc)
+	}
+	return proc
+}
+
+// routeLocked returns the process that should serve a request, nil if the caller must wait for a change.
+func (c *Controller) routeLocked(route Route) (*Process, bool, error) {
+	if route.Version != nil {
+		if route.Pending && c.next != nil && c.next.version == *route.Version {
+			return c.next, false, nil
+		}
+
+		proc, booting := c.versionLocked(*route.Version)
+		if proc != nil {
+			return proc, false, nil
+		}
+		if booting {
+			return nil, false, nil
+		}
+		if !route.Sticky {
+			return nil, false, fmt.Errorf("cannot route to version %v: %w", *route.Version, ErrVersionUnavailable)
+		}
+	}
+
+	if route.Pending && c.next != nil {
+		return c.next, false, nil
+	}
+
+	if c.current == nil || c.crashErr != nil {
+		return nil, false, nil
+	}
+
+	if c.next != nil && !c.options.ZeroDowntime {
+		return nil, false, nil
+	}
+
+	if proc := c.splitLocked(); proc != nil {
+		return proc, true, nil
+	}
+
+	return c.current, len(c.split) > 0, nil
+}
+
+// versionLocked finds the healthy process serving version, or reports whether one is still booting.
+func (c *Controller) versionLocked(version int64) (*Process, bool) {
+	if c.current != nil && c.current.version == version && c.crashErr == nil {
+		return c.current, false
+	}
+
+	if proc, ok := c.warm[version]; ok {
+		if proc.state == STATE_WARM {
+			return proc, false
+		}
+		return nil, proc.state == STATE_STARTING
+	}
+	if c.next != nil && c.next.version == version {
+		return nil, true
+	}
+
+	return nil, false
+}
+
+func (c *Controller) splitLocked() *Process {
+	if len(c.split) == 0 {
+		return nil
+	}
+
+	pick := c.random.Intn(100)
+	for version, weight := range c.split {
+		if pick < weight {
+			proc := c.warm[version]
+			if proc == nil || proc.state != STATE_WARM {
+				return nil
+			}
+			return proc
+		}
+		pick -= weight
+	}
+
+	return nil
+}
@@ -0,0 +1,338 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	dlc "github.com/gadget-inc/dateilager/pkg/client"
+	"go.uber.org/zap"
+)
+
+const (
+	WORKDIR_STAGING = ".staging"
+	WORKDIR_TRASH   = ".trash-"
+
+	DL_CACHE_DIR = "/tmp"
+)
+
+// WorkDirs rebuilds every DateiLager version into its own directory under root, so that a new version never
+// modifies the files of a process that is still running. Each build is seeded with a copy of the latest
+// version's directory, so DateiLager only has to send the diff between the two versions.
+//
+// Files are cloned copy-on-write when the filesystem supports it and copied otherwise. They can't be
+// hardlinked, as DateiLager truncates and rewrites changed files in place, which would modify them in
+// every directory sharing the inode.
+type WorkDirs struct {
+	log  *zap.Logger
+	root string
+
+	mutex    sync.Mutex
+	latest   string
+	refs     map[string]int
+	versions map[int64]string
+}
+
+func NewWorkDirs(log *zap.Logger, root string) (*WorkDirs, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workdir root %v: %w", root, err)
+	}
+
+	w := &WorkDirs{
+		log:      log,
+		root:     root,
+		refs:     make(map[string]int),
+		versions: make(map[int64]string),
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workdir root %v: %w", root, err)
+	}
+
+	// Keep the newest directory left by a previous sandbox as the seed for the first build, directories
+	// without a version file were never fully built.
+	latestVersion := int64(0)
+	var dirs []string
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		if !entry.IsDir() || entry.Name() == WORKDIR_STAGING || strings.HasPrefix(entry.Name(), WORKDIR_TRASH) {
+			dirs = append(dirs, dir)
+			continue
+		}
+
+		version, err := dlc.ReadVersionFile(dir)
+		if err != nil || version <= latestVersion {
+			dirs = append(dirs, dir)
+			continue
+		}
+
+		if w.latest != "" {
+			dirs = append(dirs, w.latest)
+		}
+		w.latest = dir
+		latestVersion = version
+	}
+
+	if w.latest != "" {
+		w.versions[latestVersion] = w.latest
+	}
+	for _, dir := range dirs {
+		w.remove(dir)
+	}
+
+	return w, nil
+}
+
+// Build returns the directory of the target version, rebuilding it from the latest directory if it doesn't
+// exist yet. Callers must serialize builds and updates.
+func (w *WorkDirs) Build(ctx context.Context, client *dlc.Client, project int64, targetVersion *int64) (string, int64, error) {
+	w.mutex.Lock()
+	latest := w.latest
+	existing, ok := "", false
+	if targetVersion != nil {
+		existing, ok = w.versions[*targetVersion]
+	}
+	w.mutex.Unlock()
+
+	if ok {
+		w.setLatest(existing)
+		return existing, *targetVersion, nil
+	}
+
+	// DateiLager only rebuilds forward, older versions are built from scratch.
+	if latest != "" && targetVersion != nil {
+		seedVersion, err := dlc.ReadVersionFile(latest)
+		if err != nil || seedVersion > *targetVersion {
+			latest = ""
+		}
+	}
+
+	staging := filepath.Join(w.root, WORKDIR_STAGING)
+	err := os.RemoveAll(staging)
+	if err != nil {
+		return "", -1, fmt.Errorf("failed to clear staging workdir: %w", err)
+	}
+
+	start := time.Now()
+	if latest != "" {
+		err = cloneTree(latest, staging)
+	} else {
+		err = os.Mkdir(staging, 0755)
+	}
+	if err != nil {
+		return "", -1, fmt.Errorf("failed to seed staging workdir from %v: %w", latest, err)
+	}
+	seeded := time.Since(start)
+
+	version, diffCount, err := client.Rebuild(ctx, project, "", targetVersion, staging, DL_CACHE_DIR)
+	if err != nil {
+		return "", -1, fmt.Errorf("failed to rebuild workdir to version %v: %w", version, err)
+	}
+
+	w.mutex.Lock()
+	dir, ok := w.versions[version]
+	w.mutex.Unlock()
+
+	if ok {
+		// Already built, the latest version didn't change since the last build.
+		os.RemoveAll(staging)
+	} else {
+		// Directories are named after the version they were built for, but hot reloads can update them to
+		// later versions in place.
+		dir = filepath.Join(w.root, fmt.Sprintf("v%d-%d", version, time.Now().UnixNano()))
+		err = os.Rename(staging, dir)
+		if err != nil {
+			return "", -1, fmt.Errorf("failed to move staging workdir to %v: %w", dir, err)
+		}
+	}
+
+	w.log.Info("built workdir", zap.String("dir", dir), zap.String("seed", latest), zap.Int64("version", version),
+		zap.Uint32("diffs", diffCount), zap.Duration("seed_duration", seeded), zap.Duration("duration", time.Since(start)))
+
+	w.mutex.Lock()
+	w.versions[version] = dir
+	w.mutex.Unlock()
+
+	w.setLatest(dir)
+	return dir, version, nil
+}
+
+// Update rebuilds dir to version in place, for hot reloading the process running from it. Callers must
+// serialize builds and updates.
+func (w *WorkDirs) Update(ctx context.Context, client *dlc.Client, project int64, dir string, version int64) error {
+	start := time.Now()
+
+	_, diffCount, err := client.Rebuild(ctx, project, "", &version, dir, DL_CACHE_DIR)
+	if err != nil {
+		// The directory may be partially updated, so it can't be reused for either version or seed the next build.
+		w.mutex.Lock()
+		w.forgetLocked(dir)
+		if w.latest == dir {
+			w.latest = ""
+		}
+		w.mutex.Unlock()
+		return fmt.Errorf("failed to update workdir %v to version %v: %w", dir, version, err)
+	}
+
+	w.log.Info("updated workdir", zap.String("dir", dir), zap.Int64("version", version),
+		zap.Uint32("diffs", diffCount), zap.Duration("duration", time.Since(start)))
+
+	w.mutex.Lock()
+	w.forgetLocked(dir)
+	w.versions[version] = dir
+	w.mutex.Unlock()
+
+	w.setLatest(dir)
+	return nil
+}
+
+func (w *WorkDirs) setLatest(dir string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	previous := w.latest
+	w.latest = dir
+
+	if previous != "" && previous != dir && w.refs[previous] == 0 {
+		w.remove(previous)
+	}
+}
+
+// Acquire marks dir as used by a process, it won't be collected until every process using it released it.
+func (w *WorkDirs) Acquire(dir string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.refs[dir] += 1
+}
+
+// Exclusive returns whether dir is used by a single process, only then can it be updated in place.
+func (w *WorkDirs) Exclusive(dir string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.refs[dir] == 1
+}
+
+// Release collects dir once it's no longer used by any process, unless it's the seed for the next build.
+func (w *WorkDirs) Release(dir string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.refs[dir] -= 1
+	if w.refs[dir] > 0 {
+		return
+	}
+
+	delete(w.refs, dir)
+	if dir != w.latest {
+		w.remove(dir)
+	}
+}
+
+func (w *WorkDirs) forgetLocked(dir string) {
+	for version, existing := range w.versions {
+		if existing == dir {
+			delete(w.versions, version)
+		}
+	}
+}
+
+// remove moves dir out of the way before deleting it in the background, so that it can be rebuilt straight away.
+// It must be called holding mutex once the WorkDirs is shared.
+func (w *WorkDirs) remove(dir string) {
+	w.forgetLocked(dir)
+
+	trash := filepath.Join(w.root, fmt.Sprintf("%s%d", WORKDIR_TRASH, time.Now().UnixNano()))
+
+	err := os.Rename(dir, trash)
+	if err != nil {
+		w.log.Warn("failed to collect workdir", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+
+	w.log.Info("collect workdir", zap.String("dir", dir))
+
+	go func() {
+		err := os.RemoveAll(trash)
+		if err != nil {
+			w.log.Warn("failed to delete workdir", zap.String("dir", dir), zap.Error(err))
+		}
+	}()
+}
+
+// cloneTree recreates src at dst, preserving modes and file modification times so DateiLager's summary of
+// the directory stays valid.
+func cloneTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case info.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+
+		case info.Mode().IsRegular():
+			err = cloneFile(path, target, info.Mode().Perm())
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+
+		default:
+			return nil
+		}
+	})
+}
+
+func cloneFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	err = reflink(out, in)
+	if errors.Is(err, errReflinkUnsupported) {
+		_, err = io.Copy(out, in)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
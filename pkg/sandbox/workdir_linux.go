@@ -0,0 +1,23 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var errReflinkUnsupported = errors.New("reflinks are not supported")
+
+// reflink shares the extents of in with out, copy-on-write, on filesystems such as btrfs and xfs.
+func reflink(out, in *os.File) error {
+	err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EXDEV), errors.Is(err, unix.EINVAL):
+		return errReflinkUnsupported
+	default:
+		return err
+	}
+}
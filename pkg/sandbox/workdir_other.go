@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os"
+)
+
+var errReflinkUnsupported = errors.New("reflinks are not supported")
+
+func reflink(out, in *os.File) error {
+	return errReflinkUnsupported
+}